@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	cloudbuildpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// buildInfoCache is the contents of --build-info-cache-file, shared between
+// sequential build steps so that only the first needs to call the API.
+type buildInfoCache struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Build     json.RawMessage `json:"build"`
+}
+
+// readBuildInfoCache returns the cached build, or nil if the cache file doesn't exist,
+// can't be parsed, is for a different build or is older than ttl.
+func readBuildInfoCache(path string, ttl time.Duration) *cloudbuildpb.Build {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if verbose {
+			InfoLogger.Printf("No usable build info cache: %v\n", err.Error())
+		}
+		return nil
+	}
+
+	// a corrupt cache is no reason to fail the step when the API can be asked instead
+	var cache buildInfoCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		if !quiet {
+			WarningLogger.Printf("Ignoring build info cache file %v: %v\n", path, err.Error())
+		}
+		return nil
+	}
+
+	if age := time.Since(cache.FetchedAt); age > ttl {
+		if verbose {
+			InfoLogger.Printf("Build info cache is stale (%v old)\n", age.Round(time.Second))
+		}
+		return nil
+	}
+
+	build := &cloudbuildpb.Build{}
+	if err := protojson.Unmarshal(cache.Build, build); err != nil {
+		if !quiet {
+			WarningLogger.Printf("Ignoring build info cache file %v: %v\n", path, err.Error())
+		}
+		return nil
+	}
+
+	if build.Id != buildId {
+		if verbose {
+			InfoLogger.Printf("Build info cache is for a different build\n")
+		}
+		return nil
+	}
+
+	if verbose {
+		InfoLogger.Printf("Using cached build info from %v\n", path)
+	}
+
+	return build
+}
+
+// writeBuildInfoCache saves build to path for later steps to read. The file is replaced
+// in one go, so a step reading it concurrently never sees it half written.
+func writeBuildInfoCache(path string, build *cloudbuildpb.Build) error {
+	buildJson, err := protojson.Marshal(build)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(buildInfoCache{FetchedAt: time.Now(), Build: buildJson})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// temporary files are private to their owner; the cache is not
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
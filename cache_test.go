@@ -0,0 +1,92 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	cloudbuildpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadBuildInfoCache(t *testing.T) {
+	savedBuildId := buildId
+	defer func() { buildId = savedBuildId }()
+	buildId = "abcdef123456"
+
+	cacheFor := func(id string, fetchedAt time.Time) string {
+		build, err := protojson.Marshal(&cloudbuildpb.Build{Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(buildInfoCache{FetchedAt: fetchedAt, Build: build})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"fresh", cacheFor("abcdef123456", time.Now()), true},
+		{"stale", cacheFor("abcdef123456", time.Now().Add(-2*time.Hour)), false},
+		{"different build", cacheFor("other", time.Now()), false},
+		{"corrupt", `{"fetchedAt":`, false},
+		{"corrupt build", `{"fetchedAt":"` + time.Now().Format(time.RFC3339) + `","build":{"id":1}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := readBuildInfoCache(path, time.Hour); (got != nil) != tt.want {
+				t.Errorf("readBuildInfoCache = %v, want a build: %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := readBuildInfoCache(filepath.Join(t.TempDir(), "missing.json"), time.Hour); got != nil {
+		t.Errorf("readBuildInfoCache of a missing file = %v, want nil", got)
+	}
+}
+
+func TestWriteBuildInfoCache(t *testing.T) {
+	savedBuildId := buildId
+	defer func() { buildId = savedBuildId }()
+	buildId = "abcdef123456"
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	if err := ioutil.WriteFile(path, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBuildInfoCache(path, &cloudbuildpb.Build{Id: buildId}); err != nil {
+		t.Fatalf("writeBuildInfoCache: %v", err)
+	}
+
+	if got := readBuildInfoCache(path, time.Hour); got == nil || got.Id != buildId {
+		t.Errorf("cache read back as %v", got)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the cache directory, want only the cache", len(files))
+	}
+}
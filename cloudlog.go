@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	logging "google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+)
+
+const (
+	// cloudLogID is the log in the build's project that --cloud-logging writes to.
+	cloudLogID = "gcbcw"
+	// cloudLogFlushInterval is how often held entries are written with --cloud-logging.
+	cloudLogFlushInterval = 10 * time.Second
+	// cloudLogWriteTimeout bounds each write of entries to Cloud Logging.
+	cloudLogWriteTimeout = 30 * time.Second
+)
+
+// cloudLogClient writes log entries to Cloud Logging for --cloud-logging.
+type cloudLogClient interface {
+	Write(ctx context.Context, req *logging.WriteLogEntriesRequest) error
+}
+
+// newCloudLogClient creates the cloudLogClient; it is replaced in tests.
+var newCloudLogClient = newLoggingClient
+
+// cloudLog holds the wrapper's log entries until they are written to Cloud Logging.
+var cloudLog *cloudLogger
+
+type loggingClient struct {
+	service *logging.Service
+}
+
+func newLoggingClient(ctx context.Context) (cloudLogClient, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+
+	service, err := logging.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingClient{service: service}, nil
+}
+
+func (c *loggingClient) Write(ctx context.Context, req *logging.WriteLogEntriesRequest) error {
+	_, err := c.service.Entries.Write(req).Context(ctx).Do()
+	return err
+}
+
+// cloudLogger collects log entries to be written to Cloud Logging in batches.
+type cloudLogger struct {
+	client cloudLogClient
+
+	mu      sync.Mutex
+	entries []*logging.LogEntry
+}
+
+// add holds an entry for message, which has fields alongside it when there are any.
+func (l *cloudLogger) add(severity, message string, fields map[string]interface{}) {
+	entry := &logging.LogEntry{
+		Severity:  severity,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if len(fields) == 0 {
+		entry.TextPayload = message
+	} else {
+		payload := map[string]interface{}{"message": message}
+		for key, value := range fields {
+			payload[key] = value
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			entry.TextPayload = message
+		} else {
+			entry.JsonPayload = data
+		}
+	}
+
+	l.mu.Lock()
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+}
+
+// flush writes the entries held so far, labeled with the build and step.
+func (l *cloudLogger) flush(ctx context.Context) error {
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = nil
+	l.mu.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	labels := map[string]string{"build_id": buildId}
+	if stepName != "" {
+		labels["step"] = stepName
+	}
+	req := &logging.WriteLogEntriesRequest{
+		LogName: fmt.Sprintf("projects/%s/logs/%s", projectId, cloudLogID),
+		Resource: &logging.MonitoredResource{
+			Type:   "build",
+			Labels: map[string]string{"build_id": buildId, "project_id": projectId},
+		},
+		Labels:  labels,
+		Entries: entries,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cloudLogWriteTimeout)
+	defer cancel()
+	return l.client.Write(ctx, req)
+}
+
+// flushEvery flushes the held entries every interval until ctx is done.
+func (l *cloudLogger) flushEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.flush(ctx); err != nil && !quiet {
+				WarningLogger.Printf("Unable to write log entries to Cloud Logging: %v\n", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cloudLogWriter passes what a logger writes on to out, and holds it as an entry of the
+// given severity to be written to Cloud Logging.
+type cloudLogWriter struct {
+	out      io.Writer
+	logger   *cloudLogger
+	severity string
+	prefix   string
+}
+
+func (w *cloudLogWriter) Write(p []byte) (int, error) {
+	// the entry has its own severity and timestamp, so the logger's are left out
+	message := strings.TrimPrefix(strings.TrimSuffix(string(p), "\n"), w.prefix)
+	if loc := logTimestamp.FindStringIndex(message); loc != nil && loc[0] == 0 {
+		message = message[loc[1]:]
+	}
+	w.logger.add(w.severity, message, nil)
+
+	return w.out.Write(p)
+}
+
+// enableCloudLogging makes the loggers also write their entries to Cloud Logging, which
+// happens every cloudLogFlushInterval until ctx is done, and at exit.
+func enableCloudLogging(ctx context.Context) error {
+	client, err := newCloudLogClient(ctx)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error creating Cloud Logging client: %v", err.Error()))
+	}
+
+	cloudLog = &cloudLogger{client: client}
+	loggers := []struct {
+		logger   *log.Logger
+		severity string
+	}{
+		{InfoLogger, "INFO"},
+		{WarningLogger, "WARNING"},
+		{ErrorLogger, "ERROR"},
+	}
+	for _, l := range loggers {
+		l.logger.SetOutput(&cloudLogWriter{out: l.logger.Writer(), logger: cloudLog, severity: l.severity, prefix: l.logger.Prefix()})
+	}
+
+	go cloudLog.flushEvery(ctx, cloudLogFlushInterval)
+	return nil
+}
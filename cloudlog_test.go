@@ -0,0 +1,183 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	logging "google.golang.org/api/logging/v2"
+)
+
+// fakeCloudLogClient records the requests it's given instead of sending them to Cloud Logging.
+type fakeCloudLogClient struct {
+	requests []*logging.WriteLogEntriesRequest
+	err      error
+}
+
+func (f *fakeCloudLogClient) Write(ctx context.Context, req *logging.WriteLogEntriesRequest) error {
+	f.requests = append(f.requests, req)
+	return f.err
+}
+
+// useFakeCloudLogClient makes --cloud-logging write to f, with loggers that write to the
+// returned buffer, and restores the loggers afterwards.
+func useFakeCloudLogClient(t *testing.T, f *fakeCloudLogClient) *bytes.Buffer {
+	savedClient, savedQuiet := newCloudLogClient, quiet
+	savedInfo, savedWarning, savedError := InfoLogger, WarningLogger, ErrorLogger
+	savedBuild, savedProject, savedStep := buildId, projectId, stepName
+	t.Cleanup(func() {
+		newCloudLogClient, quiet = savedClient, savedQuiet
+		InfoLogger, WarningLogger, ErrorLogger = savedInfo, savedWarning, savedError
+		buildId, projectId, stepName = savedBuild, savedProject, savedStep
+		cloudLog = nil
+	})
+
+	newCloudLogClient = func(context.Context) (cloudLogClient, error) {
+		if f == nil {
+			return nil, errors.New("no credentials")
+		}
+		return f, nil
+	}
+	quiet = false
+	buildId, projectId, stepName = "build-123", "project-456", "compile"
+
+	var out bytes.Buffer
+	InfoLogger = log.New(&out, "INFO: ", log.LstdFlags)
+	WarningLogger = log.New(&out, "WARNING: ", log.LstdFlags)
+	ErrorLogger = log.New(&out, "ERROR: ", log.LstdFlags)
+	return &out
+}
+
+func TestCloudLogging(t *testing.T) {
+	f := &fakeCloudLogClient{}
+	out := useFakeCloudLogClient(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := enableCloudLogging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// only the explicit flush below writes entries
+	cancel()
+
+	InfoLogger.Println("Starting process")
+	WarningLogger.Printf("Timeout has been reached; sending %v signal to process\n", "SIGTERM")
+	ErrorLogger.Println("error running command")
+	if err := cloudLog.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "WARNING: ") || !strings.Contains(out.String(), "Starting process") {
+		t.Errorf("loggers no longer write their usual output: %q", out.String())
+	}
+	if len(f.requests) != 1 {
+		t.Fatalf("got %d write requests, want 1", len(f.requests))
+	}
+	req := f.requests[0]
+	if req.LogName != "projects/project-456/logs/gcbcw" {
+		t.Errorf("got log name %q", req.LogName)
+	}
+	if want := map[string]string{"build_id": "build-123", "step": "compile"}; !reflect.DeepEqual(req.Labels, want) {
+		t.Errorf("got labels %v, want %v", req.Labels, want)
+	}
+	if req.Resource == nil || req.Resource.Type != "build" || req.Resource.Labels["build_id"] != "build-123" {
+		t.Errorf("got resource %+v, want the build", req.Resource)
+	}
+
+	want := []struct {
+		severity string
+		message  string
+	}{
+		{"INFO", "Starting process"},
+		{"WARNING", "Timeout has been reached; sending SIGTERM signal to process"},
+		{"ERROR", "error running command"},
+	}
+	if len(req.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(req.Entries), len(want))
+	}
+	for i, entry := range req.Entries {
+		if entry.Severity != want[i].severity || entry.TextPayload != want[i].message {
+			t.Errorf("entry %d is %v %q, want %v %q", i, entry.Severity, entry.TextPayload, want[i].severity, want[i].message)
+		}
+		if entry.Timestamp == "" {
+			t.Errorf("entry %d has no timestamp", i)
+		}
+	}
+
+	// nothing is held once it has been written
+	if err := cloudLog.flush(context.Background()); err != nil || len(f.requests) != 1 {
+		t.Errorf("flushing again returned %v after %d requests", err, len(f.requests))
+	}
+}
+
+func TestCloudLoggingFields(t *testing.T) {
+	f := &fakeCloudLogClient{}
+	useFakeCloudLogClient(t, f)
+	var out bytes.Buffer
+	InfoLogger = log.New(&jsonLogWriter{out: &out, severity: "INFO"}, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := enableCloudLogging(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	logFields(InfoLogger, "Child process exited", map[string]string{"pid": "42"})
+	flushLogs()
+
+	if !strings.Contains(out.String(), `"pid":"42"`) {
+		t.Errorf("JSON log output %q is missing the fields", out.String())
+	}
+	if len(f.requests) != 1 || len(f.requests[0].Entries) != 1 {
+		t.Fatalf("got requests %+v, want one entry", f.requests)
+	}
+	entry := f.requests[0].Entries[0]
+	var payload map[string]interface{}
+	if err := json.Unmarshal(entry.JsonPayload, &payload); err != nil {
+		t.Fatalf("entry payload %q isn't JSON: %v", entry.JsonPayload, err)
+	}
+	if entry.Severity != "INFO" || payload["message"] != "Child process exited" || payload["pid"] != "42" {
+		t.Errorf("got %v entry with payload %v", entry.Severity, payload)
+	}
+}
+
+func TestCloudLoggingFailure(t *testing.T) {
+	out := useFakeCloudLogClient(t, nil)
+	logger := InfoLogger
+
+	if err := enableCloudLogging(context.Background()); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("enableCloudLogging returned %v, want the client error", err)
+	}
+	if cloudLog != nil || logger.Writer() != out {
+		t.Error("loggers were changed despite the client failing")
+	}
+
+	f := &fakeCloudLogClient{err: errors.New("permission denied")}
+	out = useFakeCloudLogClient(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := enableCloudLogging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	InfoLogger.Println("Starting process")
+	flushLogs()
+	if !strings.Contains(out.String(), "Unable to write log entries to Cloud Logging: permission denied") {
+		t.Errorf("output %q doesn't report the failed write", out.String())
+	}
+}
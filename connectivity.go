@@ -0,0 +1,54 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// connectivityTimeout bounds each step of the --check-connectivity preflight.
+const connectivityTimeout = 5 * time.Second
+
+// checkConnectivity resolves and dials endpoint, a host:port, so that network problems
+// reaching the API can be reported as such rather than surfacing from the API call.
+func checkConnectivity(ctx context.Context, endpoint string) error {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, connectivityTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(lookupCtx, host)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to resolve Cloud Build API host %v; check DNS settings: %v", host, err.Error()))
+	}
+
+	if verbose {
+		InfoLogger.Printf("Resolved %v to %v\n", host, addrs)
+	}
+
+	dialer := &net.Dialer{Timeout: connectivityTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to connect to Cloud Build API at %v; check firewall rules and VPC Service Controls: %v", endpoint, err.Error()))
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckConnectivity(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := checkConnectivity(context.Background(), listener.Addr().String()); err != nil {
+		t.Errorf("checking a listening endpoint returned %v", err)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	if err := checkConnectivity(context.Background(), closedAddr); err == nil || !strings.Contains(err.Error(), "unable to connect") {
+		t.Errorf("checking a closed port returned %v, want a connection error", err)
+	}
+
+	if err := checkConnectivity(context.Background(), "no-port"); err == nil {
+		t.Error("checking an endpoint without a port succeeded")
+	}
+}
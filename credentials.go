@@ -0,0 +1,92 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2/google"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// credentialsPollInterval is how often --wait-for-credentials checks for credentials.
+var credentialsPollInterval = 2 * time.Second
+
+// cloudPlatformScope is the OAuth scope used by the Cloud Build client.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// waitForCredentials waits up to timeout for --credentials-file or application default
+// credentials to be available and able to produce a token. Only missing credentials are
+// waited for; credentials that are present but can't be used fail straight away.
+func waitForCredentials(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := checkCredentials(ctx)
+		if err == nil {
+			return nil
+		}
+		if !credentialsMissing(err) {
+			return errors.New(fmt.Sprintf("credentials are not usable: %v", err.Error()))
+		}
+
+		if time.Now().Add(credentialsPollInterval).After(deadline) {
+			return errors.New(fmt.Sprintf("no credentials available after waiting %v: %v", timeout, err.Error()))
+		}
+
+		if verbose {
+			InfoLogger.Printf("Credentials not yet available, retrying: %v\n", err.Error())
+		}
+		time.Sleep(credentialsPollInterval)
+	}
+}
+
+// credentialsMissing reports whether err from checkCredentials is due to there being no
+// credentials yet, rather than to the credentials found being invalid.
+func credentialsMissing(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	// the oauth2 package formats these errors into its own rather than wrapping them
+	message := err.Error()
+	return strings.Contains(message, "could not find default credentials") ||
+		strings.Contains(message, syscall.ENOENT.Error())
+}
+
+func checkCredentials(ctx context.Context) error {
+	var creds *google.Credentials
+	var err error
+	if credentialsFile != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(credentialsFile); err != nil {
+			return err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = creds.TokenSource.Token()
+	return err
+}
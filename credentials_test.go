@@ -0,0 +1,74 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForCredentialsFileAppearing(t *testing.T) {
+	savedFile, savedInterval := credentialsFile, credentialsPollInterval
+	defer func() { credentialsFile, credentialsPollInterval = savedFile, savedInterval }()
+	credentialsFile = filepath.Join(t.TempDir(), "key.json")
+	credentialsPollInterval = 10 * time.Millisecond
+
+	// the file turns up after a while, but isn't a usable key, which should end the wait
+	time.AfterFunc(50*time.Millisecond, func() {
+		_ = ioutil.WriteFile(credentialsFile, []byte(`{"type":"unknown"}`), 0600)
+	})
+
+	started := time.Now()
+	err := waitForCredentials(context.Background(), 10*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "not usable") {
+		t.Errorf("error = %v, want one reporting unusable credentials", err)
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("waited %v; want until the file appeared and no longer", elapsed)
+	}
+}
+
+func TestWaitForCredentialsTimesOut(t *testing.T) {
+	savedFile, savedInterval := credentialsFile, credentialsPollInterval
+	defer func() { credentialsFile, credentialsPollInterval = savedFile, savedInterval }()
+	credentialsFile = filepath.Join(t.TempDir(), "key.json")
+	credentialsPollInterval = 10 * time.Millisecond
+
+	err := waitForCredentials(context.Background(), 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no credentials available") {
+		t.Errorf("error = %v, want one reporting no credentials", err)
+	}
+}
+
+func TestCredentialsMissing(t *testing.T) {
+	savedFile := credentialsFile
+	defer func() { credentialsFile = savedFile }()
+
+	credentialsFile = filepath.Join(t.TempDir(), "key.json")
+	if err := checkCredentials(context.Background()); err == nil || !credentialsMissing(err) {
+		t.Errorf("missing file: error %v not treated as missing credentials", err)
+	}
+
+	if err := ioutil.WriteFile(credentialsFile, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCredentials(context.Background()); err == nil || credentialsMissing(err) {
+		t.Errorf("invalid file: error %v treated as missing credentials", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// gcsUploadTimeout bounds the --gcs-log-uri upload at exit.
+const gcsUploadTimeout = 2 * time.Minute
+
+// logUploader uploads the captured process output for --gcs-log-uri.
+type logUploader interface {
+	Upload(ctx context.Context, bucket, object string, r io.Reader) error
+}
+
+// newLogUploader creates the logUploader; it is replaced in tests.
+var newLogUploader = newGCSUploader
+
+// gcsLog captures the process output to be uploaded for --gcs-log-uri.
+var gcsLog *os.File
+
+type gcsUploader struct {
+	service *storage.Service
+}
+
+func newGCSUploader(ctx context.Context) (logUploader, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+
+	service, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsUploader{service: service}, nil
+}
+
+func (u *gcsUploader) Upload(ctx context.Context, bucket, object string, r io.Reader) error {
+	obj := &storage.Object{Name: object, ContentType: "text/plain; charset=utf-8"}
+	_, err := u.service.Objects.Insert(bucket, obj).Media(r).Context(ctx).Do()
+	return err
+}
+
+// parseGCSURI splits a gs://bucket/object URI into its bucket and object names.
+func parseGCSURI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return "", "", errors.New(fmt.Sprintf("%q is not a gs:// URI", uri))
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(uri, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.HasSuffix(parts[1], "/") {
+		return "", "", errors.New(fmt.Sprintf("%q must name both a bucket and an object, as gs://bucket/path", uri))
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// openGCSLog creates the temporary file the process output is captured in until it is
+// uploaded.
+func openGCSLog() error {
+	f, err := ioutil.TempFile("", "gcbcw-log-")
+	if err != nil {
+		return errors.New(fmt.Sprintf("error creating file to capture output for --gcs-log-uri: %v", err.Error()))
+	}
+
+	gcsLog = f
+	return nil
+}
+
+// uploadGCSLog uploads the captured process output to uri, logging the outcome, and
+// removes the temporary file it was captured in.
+func uploadGCSLog(uri string) {
+	f := gcsLog
+	gcsLog = nil
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := uploadFile(f, uri); err != nil {
+		if !quiet {
+			WarningLogger.Printf("Unable to upload process output to %v: %v\n", uri, err.Error())
+		}
+		return
+	}
+
+	if !quiet {
+		InfoLogger.Printf("Uploaded process output to %v\n", uri)
+	}
+}
+
+func uploadFile(f *os.File, uri string) error {
+	bucket, object, err := parseGCSURI(uri)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gcsUploadTimeout)
+	defer cancel()
+
+	uploader, err := newLogUploader(ctx)
+	if err != nil {
+		return err
+	}
+	return uploader.Upload(ctx, bucket, object, f)
+}
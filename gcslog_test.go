@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeUploader records what it's asked to upload instead of sending it to Cloud Storage.
+type fakeUploader struct {
+	bucket, object string
+	content        string
+	err            error
+}
+
+func (f *fakeUploader) Upload(ctx context.Context, bucket, object string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.bucket, f.object, f.content = bucket, object, string(data)
+	return f.err
+}
+
+func useFakeUploader(t *testing.T, f *fakeUploader) {
+	saved := newLogUploader
+	t.Cleanup(func() { newLogUploader = saved })
+	newLogUploader = func(context.Context) (logUploader, error) {
+		return f, nil
+	}
+}
+
+func TestParseGCSURI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantBucket string
+		wantObject string
+		wantErr    bool
+	}{
+		{"gs://bucket/step.log", "bucket", "step.log", false},
+		{"gs://bucket/logs/build/step.log", "bucket", "logs/build/step.log", false},
+		{"gs://bucket", "", "", true},
+		{"gs://bucket/", "", "", true},
+		{"gs://bucket/logs/", "", "", true},
+		{"gs:///step.log", "", "", true},
+		{"s3://bucket/step.log", "", "", true},
+	}
+	for _, tt := range tests {
+		bucket, object, err := parseGCSURI(tt.uri)
+		if bucket != tt.wantBucket || object != tt.wantObject || (err != nil) != tt.wantErr {
+			t.Errorf("parseGCSURI(%q) = %q, %q, %v; want %q, %q, error %v", tt.uri, bucket, object, err, tt.wantBucket, tt.wantObject, tt.wantErr)
+		}
+	}
+}
+
+func TestUploadGCSLog(t *testing.T) {
+	savedQuiet, savedLogger := quiet, InfoLogger
+	defer func() { quiet, InfoLogger = savedQuiet, savedLogger }()
+	var info bytes.Buffer
+	InfoLogger = log.New(&info, "", 0)
+	quiet = false
+
+	f := &fakeUploader{}
+	useFakeUploader(t, f)
+	if err := openGCSLog(); err != nil {
+		t.Fatal(err)
+	}
+	name := gcsLog.Name()
+	if _, err := gcsLog.WriteString("hello\nworld\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadGCSLog("gs://bucket/logs/step.log")
+	if f.bucket != "bucket" || f.object != "logs/step.log" || f.content != "hello\nworld\n" {
+		t.Errorf("uploaded %q to bucket %q object %q", f.content, f.bucket, f.object)
+	}
+	if !strings.Contains(info.String(), "Uploaded process output to gs://bucket/logs/step.log") {
+		t.Errorf("logged %q, want the upload reported", info.String())
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("captured output file %v wasn't removed: %v", name, err)
+	}
+}
+
+func TestUploadGCSLogFailure(t *testing.T) {
+	savedQuiet := quiet
+	defer func() { quiet = savedQuiet }()
+	warnings := captureWarnings(t)
+
+	useFakeUploader(t, &fakeUploader{err: errors.New("permission denied")})
+	if err := openGCSLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadGCSLog("gs://bucket/step.log")
+	if !strings.Contains(warnings.String(), "Unable to upload process output to gs://bucket/step.log: permission denied") {
+		t.Errorf("warnings %q don't report the failed upload", warnings.String())
+	}
+}
@@ -5,5 +5,9 @@ go 1.14
 require (
 	cloud.google.com/go/cloudbuild v1.2.0
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
+	google.golang.org/api v0.70.0
 	google.golang.org/genproto v0.0.0-20220329172620-7be39ac1afc7
+	google.golang.org/grpc v1.45.0
+	google.golang.org/protobuf v1.28.0
 )
@@ -0,0 +1,238 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logTimestamp matches the date and time written by a logger using log.LstdFlags.
+var logTimestamp = regexp.MustCompile(`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d `)
+
+// logSignalTime is the time the process is to be signaled, included in JSON log entries
+// once known.
+var logSignalTime time.Time
+
+// dedupWriters holds the writers installed by enableLogDedup, to be flushed on exit.
+var dedupWriters []*dedupWriter
+
+// dedupWriter collapses consecutive identical log lines, ignoring their timestamps, into
+// the first line followed by a "last message repeated N times" line.
+type dedupWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	last    []byte
+	header  []byte
+	repeats int
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key, header := p, []byte(nil)
+	if loc := logTimestamp.FindIndex(p); loc != nil {
+		key = append(append([]byte{}, p[:loc[0]]...), p[loc[1]:]...)
+		header = p[:loc[1]]
+	}
+
+	if w.last != nil && bytes.Equal(key, w.last) {
+		w.repeats++
+		w.header = append(w.header[:0], header...)
+		return len(p), nil
+	}
+
+	if err := w.flushRepeats(); err != nil {
+		return 0, err
+	}
+
+	w.last = append(w.last[:0], key...)
+	return w.out.Write(p)
+}
+
+func (w *dedupWriter) flushRepeats() error {
+	if w.repeats == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w.out, "%slast message repeated %d times\n", w.header, w.repeats)
+	w.repeats = 0
+	return err
+}
+
+// Flush writes out any pending repeat count.
+func (w *dedupWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flushRepeats()
+}
+
+// enableLogDedup switches the loggers over to collapsing repeated lines.
+func enableLogDedup() {
+	stdout := &dedupWriter{out: os.Stdout}
+	stderr := &dedupWriter{out: os.Stderr}
+	dedupWriters = append(dedupWriters, stdout, stderr)
+
+	InfoLogger.SetOutput(stdout)
+	WarningLogger.SetOutput(stdout)
+	ErrorLogger.SetOutput(stderr)
+}
+
+// flushLogs writes out anything the loggers are holding back.
+func flushLogs() {
+	if cloudLog != nil {
+		// anything still working on the wrapper's behalf has been stopped by now
+		if err := cloudLog.flush(context.Background()); err != nil && !quiet {
+			WarningLogger.Printf("Unable to write log entries to Cloud Logging: %v\n", err.Error())
+		}
+	}
+	for _, w := range dedupWriters {
+		_ = w.Flush()
+	}
+}
+
+// jsonLogEntry is a single log line written with --log-format=json.
+type jsonLogEntry struct {
+	Severity   string `json:"severity"`
+	Message    string `json:"message"`
+	Timestamp  string `json:"timestamp"`
+	BuildID    string `json:"buildId,omitempty"`
+	Step       string `json:"step,omitempty"`
+	SignalTime string `json:"signalTime,omitempty"`
+}
+
+// jsonLogWriter writes each message it is given as a JSON log entry of the given severity.
+type jsonLogWriter struct {
+	out      io.Writer
+	severity string
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.writeEntry(strings.TrimSuffix(string(p), "\n"), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeEntry writes message as a JSON log entry, with fields added alongside the standard ones.
+func (w *jsonLogWriter) writeEntry(message string, fields map[string]interface{}) error {
+	entry := jsonLogEntry{
+		Severity:  w.severity,
+		Message:   message,
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		BuildID:   buildId,
+		Step:      stepName,
+	}
+	if !logSignalTime.IsZero() {
+		entry.SignalTime = logSignalTime.Format(time.RFC3339)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if len(fields) > 0 {
+		combined := map[string]interface{}{}
+		if err := json.Unmarshal(data, &combined); err != nil {
+			return err
+		}
+		for key, value := range fields {
+			combined[key] = value
+		}
+		if data, err = json.Marshal(combined); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.out.Write(append(data, '\n'))
+	return err
+}
+
+// logFields logs message along with fields, which are separate keys of the entry with
+// --log-format=json and are appended to the message as key=value pairs otherwise.
+func logFields(logger *log.Logger, message string, fields map[string]string) {
+	out := logger.Writer()
+	cloud, toCloud := out.(*cloudLogWriter)
+	if toCloud {
+		out = cloud.out
+	}
+
+	if w, ok := out.(*jsonLogWriter); ok {
+		values := make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			values[key] = value
+		}
+		_ = w.writeEntry(message, values)
+		if toCloud {
+			cloud.logger.add(cloud.severity, message, values)
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := fields[key]
+		if strings.ContainsAny(value, " \"") {
+			value = strconv.Quote(value)
+		}
+		pairs[i] = key + "=" + value
+	}
+	logger.Printf("%v; %v\n", message, strings.Join(pairs, " "))
+}
+
+// logDuration formats d for logFields, as seconds in the way durations appear in the
+// Cloud Build API.
+func logDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3fs", d.Seconds())
+}
+
+// enableJSONLogs switches the loggers over to writing JSON log entries.
+func enableJSONLogs() {
+	loggers := []struct {
+		logger   *log.Logger
+		out      io.Writer
+		severity string
+	}{
+		{InfoLogger, os.Stdout, "INFO"},
+		{WarningLogger, os.Stdout, "WARNING"},
+		{ErrorLogger, os.Stderr, "ERROR"},
+	}
+
+	for _, l := range loggers {
+		l.logger.SetOutput(&jsonLogWriter{out: l.out, severity: l.severity})
+		l.logger.SetPrefix("")
+		l.logger.SetFlags(0)
+	}
+}
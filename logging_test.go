@@ -0,0 +1,88 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogFieldsText(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New(&out, "", 0)
+
+	logFields(logger, "Process exited", map[string]string{"b": "2", "a": "exit status 1"})
+	if got, want := out.String(), "Process exited; a=\"exit status 1\" b=2\n"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestLogFieldsJSON(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New(&jsonLogWriter{out: &out, severity: "INFO"}, "", 0)
+
+	logFields(logger, "Process exited", map[string]string{"signal_to_exit_duration": "1.500s"})
+	var entry map[string]string
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("logged %q, which isn't a JSON entry: %v", out.String(), err)
+	}
+	if entry["message"] != "Process exited" || entry["severity"] != "INFO" || entry["signal_to_exit_duration"] != "1.500s" {
+		t.Errorf("logged %q", strings.TrimSpace(out.String()))
+	}
+}
+
+func TestDedupWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{
+			"distinct lines",
+			[]string{"INFO: 2020/01/01 00:00:00 a\n", "INFO: 2020/01/01 00:00:01 b\n"},
+			"INFO: 2020/01/01 00:00:00 a\nINFO: 2020/01/01 00:00:01 b\n",
+		},
+		{
+			"repeats with different timestamps",
+			[]string{"INFO: 2020/01/01 00:00:00 a\n", "INFO: 2020/01/01 00:00:01 a\n", "INFO: 2020/01/01 00:00:02 a\n", "INFO: 2020/01/01 00:00:03 b\n"},
+			"INFO: 2020/01/01 00:00:00 a\nINFO: 2020/01/01 00:00:02 last message repeated 2 times\nINFO: 2020/01/01 00:00:03 b\n",
+		},
+		{
+			"repeats flushed at the end",
+			[]string{"a\n", "a\n"},
+			"a\nlast message repeated 1 times\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &dedupWriter{out: &out}
+			for _, line := range tt.lines {
+				if _, err := w.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("wrote %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
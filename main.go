@@ -17,35 +17,202 @@ package main
 import (
 	cloudbuild "cloud.google.com/go/cloudbuild/apiv1"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/spf13/pflag"
+	"google.golang.org/api/option"
 	cloudbuildpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
+// version, commit and buildDate are set at build time, e.g.
+// go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse --short HEAD)"
 var (
-	timeoutSigStr   string
-	timeoutStr      string
-	timeoutDur      time.Duration
-	verbose         bool
-	quiet           bool
-	timeoutExitCode int
-	processTimedOut bool
-	projectId       string
-	buildId         string
-	cmdName         string
-	cmdArgs         []string
-	InfoLogger      *log.Logger
-	WarningLogger   *log.Logger
-	ErrorLogger     *log.Logger
-	validSignals    = map[string]os.Signal{
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// safetyMarginFactor is the multiple of API latency subtracted from the signal time
+// with --auto-safety-margin.
+const safetyMarginFactor = 2
+
+// sentinelPollInterval is how often the --signal-on-file path is checked.
+const sentinelPollInterval = time.Second
+
+// apiRetryBackoff is the delay before the first retry of a failed API call; it
+// doubles with each further retry.
+const apiRetryBackoff = time.Second
+
+// noSignalTimeout is passed to runCommand when the process isn't to be signaled for
+// the build timeout, because the build has none.
+const noSignalTimeout = time.Duration(-1 << 63)
+
+// defaultAPIEndpoint is the endpoint of the global Cloud Build API.
+const defaultAPIEndpoint = "cloudbuild.googleapis.com:443"
+
+// redactedValue replaces secret-looking command arguments in logs.
+const redactedValue = "[REDACTED]"
+
+// defaultRedactArgs matches KEY=VALUE arguments whose key looks secret, and values
+// that look like well-known kinds of access token.
+const defaultRedactArgs = `(?i)(token|secret|passw(or)?d|api[-_]?key|credential)[^=]*=|^(ghp_|gho_|xox[abp]-|AKIA|ya29\.)`
+
+var (
+	signalStr               string
+	timeoutSigStr           string
+	timeoutStr              string
+	timeoutDur              time.Duration
+	jitterStr               string
+	jitterDur               time.Duration
+	warnBeforeStr           string
+	warnBeforeDur           time.Duration
+	verbose                 bool
+	quiet                   bool
+	logExitDetails          bool
+	validateOnly            bool
+	newSession              bool
+	reconcileStatus         bool
+	deadlineBase            string
+	aliasFile               string
+	aliasName               string
+	allowTightTiming        bool
+	exitCodeFile            string
+	signalDryRun            bool
+	keepaliveOnHup          bool
+	buildInfoCacheFile      string
+	buildInfoCacheTTLStr    string
+	buildInfoCacheTTLDur    time.Duration
+	noCleanupChildren       bool
+	remainingPercent        float64
+	dumpFlagsFormat         string
+	fallbackSigStr          string
+	teeFd                   int
+	teeFile                 *os.File
+	autoSafetyMargin        bool
+	signalOnFile            string
+	signalOnFileExisting    string
+	logDedup                bool
+	timestampOutput         bool
+	timestampFormat         string
+	holdStdinOpen           bool
+	upgradeFirstSignal      bool
+	stepName                string
+	minLeadStr              string
+	minLeadDur              time.Duration
+	maxLeadStr              string
+	maxLeadDur              time.Duration
+	pprofAddr               string
+	redactArgsStr           string
+	redactPattern           *regexp.Regexp
+	maxLineLength           int
+	killAfterStr            string
+	killAfterDur            time.Duration
+	escalateIfSilentStr     string
+	maxOutputRate           int
+	maxOutputLineRate       int
+	outputRateWindowStr     string
+	outputRateWindowDur     time.Duration
+	outputRateSigStr        string
+	diagnosticSigStr        string
+	diagnosticGraceStr      string
+	diagnosticGraceDur      time.Duration
+	escalateIfSilentDur     time.Duration
+	killSigStr              string
+	waitForCredsStr         string
+	waitForCredsDur         time.Duration
+	region                  string
+	restartSigStr           string
+	refreshOnRestart        bool
+	restartCutoffStr        string
+	restartCutoffDur        time.Duration
+	apiRetries              int
+	fallbackTimeoutStr      string
+	fallbackTimeoutDur      time.Duration
+	timeoutCombinePolicy    string
+	processGroup            bool
+	gracefulExitCode        int
+	processKilled           bool
+	checkConnectivityFlag   bool
+	timeoutPercent          float64
+	deadlineSubstitution    string
+	logFormat               string
+	jsonProcessOutput       bool
+	cloudLogging            bool
+	apiTimeoutStr           string
+	apiTimeoutDur           time.Duration
+	shortIdLength           int
+	preSignalHook           string
+	preSignalHookTimeoutStr string
+	preSignalHookTimeoutDur time.Duration
+	forwardMinIntervalStr   string
+	forwardMinIntervalDur   time.Duration
+	pollIntervalStr         string
+	pollIntervalDur         time.Duration
+	pollIntervalMaxStr      string
+	pollIntervalMaxDur      time.Duration
+	workdirFromEnv          string
+	commandDir              string
+	apiEndpoint             string
+	apiInsecure             bool
+	credentialsFile         string
+	childExitGraceStr       string
+	childExitGraceDur       time.Duration
+	noStdin                 bool
+	preemptAware            bool
+	dryRun                  bool
+	workdir                 string
+	envOverrides            []string
+	countdownIntervalStr    string
+	countdownIntervalDur    time.Duration
+	escalationStages        []escalationStage
+	stdoutFile              string
+	stderrFile              string
+	stdoutCopy              *os.File
+	stderrCopy              *os.File
+	gcsLogURI               string
+	useShell                bool
+	parallelChildren        bool
+	parallelExitPolicy      string
+	shellPath               string
+	notifyURL               string
+	minRuntimeStr           string
+	minRuntimeDur           time.Duration
+	buildInfoFile           string
+	cancelMain              context.CancelFunc
+	timeoutExitCode         int
+	processTimedOut         bool
+	buildDeadline           time.Time
+	buildTimeout            time.Duration
+	exportFile              string
+	projectId               string
+	buildId                 string
+	cmdName                 string
+	cmdArgs                 []string
+	InfoLogger              *log.Logger
+	WarningLogger           *log.Logger
+	ErrorLogger             *log.Logger
+	validSignals            = map[string]os.Signal{
 		"SIGABRT":   syscall.SIGABRT,
 		"SIGALRM":   syscall.SIGALRM,
 		"SIGBUS":    syscall.SIGBUS,
@@ -56,7 +223,6 @@ var (
 		"SIGILL":    syscall.SIGILL,
 		"SIGINT":    syscall.SIGINT,
 		"SIGIO":     syscall.SIGIO,
-		"SIGIOT":    syscall.SIGIOT,
 		"SIGKILL":   syscall.SIGKILL,
 		"SIGPIPE":   syscall.SIGPIPE,
 		"SIGPROF":   syscall.SIGPROF,
@@ -77,6 +243,19 @@ var (
 		"SIGXCPU":   syscall.SIGXCPU,
 		"SIGXFSZ":   syscall.SIGXFSZ,
 	}
+	// signalAliases maps alternate or platform-specific signal names to the
+	// name of the equivalent signal in validSignals.
+	signalAliases = map[string]string{
+		"SIGIOT":  "SIGABRT",
+		"SIGPOLL": "SIGIO",
+		"SIGCLD":  "SIGCHLD",
+	}
+	// uncatchableSignals can't be handled by the process, so can't ask it to shut down
+	// gracefully.
+	uncatchableSignals = map[string]bool{
+		"SIGKILL": true,
+		"SIGSTOP": true,
+	}
 )
 
 type UserRequestedHelp struct{}
@@ -85,181 +264,2402 @@ func (e *UserRequestedHelp) Error() string {
 	return "user requested help"
 }
 
-func runCommand(cmdName string, cmdArgs []string, timeout time.Duration, sigChan chan os.Signal) error {
-	cmd := exec.Command(cmdName, cmdArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+type UserRequestedVersion struct{}
 
-	done := make(chan error, 1)
+func (e *UserRequestedVersion) Error() string {
+	return "user requested version"
+}
 
-	go func() {
-		if verbose {
-			InfoLogger.Printf("Running command: %v %v", cmdName, strings.Join(cmdArgs, " "))
-		}
-		done <- cmd.Run()
-	}()
+type UserRequestedFlagDump struct{}
 
-	var err error
+func (e *UserRequestedFlagDump) Error() string {
+	return "user requested flag dump"
+}
 
-	select {
-	case err := <-done:
-		return err
-	case recdSig := <-sigChan:
-		if !quiet {
-			WarningLogger.Printf("Parent process received signal %v; forwarding to child command process\n", recdSig.String())
-		}
-		err = cmd.Process.Signal(recdSig)
-	case <-time.After(timeout):
-		if !quiet {
-			WarningLogger.Printf("Timeout has been reached; sending %v signal to process", timeoutSigStr)
-		}
-		processTimedOut = true
-		err = cmd.Process.Signal(validSignals[timeoutSigStr])
-	}
+// BuildUnavailable is returned when the build couldn't be retrieved at all.
+type BuildUnavailable struct {
+	Err error
+}
 
-	if verbose {
-		InfoLogger.Printf("Waiting on process to exit...")
+func (e *BuildUnavailable) Error() string {
+	return e.Err.Error()
+}
+
+// InvalidArgs collects every problem found with the supplied flags and arguments,
+// so they can all be reported at once.
+type InvalidArgs struct {
+	Problems []string
+}
+
+func (e *InvalidArgs) Error() string {
+	return strings.Join(e.Problems, "\n")
+}
+
+// escalationStage is an early signal from a comma-separated --signal and --before-timeout
+// list, sent ahead of the final one.
+type escalationStage struct {
+	signal  string
+	lead    time.Duration
+	percent float64
+}
+
+// leadFor returns how long before a build with the given timeout the stage is reached.
+func (s escalationStage) leadFor(buildTimeout time.Duration) time.Duration {
+	if s.percent > 0 {
+		return time.Duration(float64(buildTimeout) * s.percent / 100)
 	}
-	err = <-done
-	return err
+	return s.lead
 }
 
-func getBuildSignalTime(ctx context.Context) (*time.Time, error) {
-	if verbose {
-		InfoLogger.Println("Getting build info from Cloud Build API")
+// parseLead parses a --before-timeout value, either a duration or a percentage of the
+// build timeout, returning whichever it is.
+func parseLead(value string) (time.Duration, float64, error) {
+	if !strings.HasSuffix(value, "%") {
+		dur, err := time.ParseDuration(value)
+		return dur, 0, err
 	}
 
-	c, err := cloudbuild.NewClient(ctx)
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Error creating Cloud Build client: %v", err.Error()))
+		return 0, 0, err
 	}
+	if percent <= 0 || percent >= 100 {
+		return 0, 0, errors.New("percentage must be between 0% and 100%, exclusive")
+	}
+	return 0, percent, nil
+}
 
-	req := &cloudbuildpb.GetBuildRequest{
-		ProjectId: projectId,
-		Id:        buildId,
+// canonicalSignalName translates a signal name to the name used for it in validSignals,
+// warning when an alias was translated. It is an error if the signal does not exist on
+// this platform.
+func canonicalSignalName(name string) (string, error) {
+	if canonical, ok := signalAliases[name]; ok {
+		if !quiet {
+			WarningLogger.Printf("Signal %v is an alias on %v; using %v\n", name, runtime.GOOS, canonical)
+		}
+		name = canonical
 	}
 
-	resp, err := c.GetBuild(ctx, req)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("error getting build from API; check project and build ID: %v; ", err.Error()))
+	if _, ok := validSignals[name]; !ok {
+		return "", errors.New(fmt.Sprintf("%v is not a valid, catchable signal on %v", name, runtime.GOOS))
 	}
 
-	buildTimeoutTime := resp.StartTime.Seconds + resp.Timeout.Seconds
-	signalTime := time.Unix(buildTimeoutTime-int64(timeoutDur.Seconds()), 0)
+	return name, nil
+}
 
-	if signalTime.Before(time.Now()) {
-		return nil, errors.New(fmt.Sprintf("invalid signal time '%v' for build ID '%v': occurs in the past", signalTime, buildId[:8]))
+// warnIfIgnoredByDefault warns that sending the named signal is a no-op unless the
+// process installs a handler for it.
+func warnIfIgnoredByDefault(flag, name string) {
+	if ignoredByDefault[name] && !quiet {
+		WarningLogger.Printf("%v %v is ignored by default on %v; it will have no effect unless the process handles it\n", flag, name, runtime.GOOS)
 	}
+}
 
-	if verbose {
-		InfoLogger.Printf("Cloud Build timeout is %v seconds\n", resp.Timeout.Seconds)
-		InfoLogger.Printf("Cloud Build container will be terminated at %v\n", time.Unix(buildTimeoutTime, 0))
-		InfoLogger.Printf("Process will be signaled at %v\n", signalTime)
+// signalName returns the name of sig as used in validSignals, e.g. SIGTERM.
+func signalName(sig os.Signal) string {
+	for name, s := range validSignals {
+		if s == sig {
+			return name
+		}
 	}
 
-	return &signalTime, nil
+	return sig.String()
 }
 
-func parseArgs() (int, error) {
-	pflag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s: [flags ...] PROJECT_ID BUILD_ID -- COMMAND [command-flags ...]\n", os.Args[0])
-		pflag.CommandLine.PrintDefaults()
+// isProcessDone reports whether err is due to the process having already exited.
+func isProcessDone(err error) bool {
+	return errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH)
+}
+
+// signalWithFallback sends sig to the wrapped command, retrying once if sending fails
+// for any reason other than the process having exited, and then trying --fallback-signal.
+func signalWithFallback(cmd commandRunner, sig os.Signal) error {
+	err := cmd.Signal(sig)
+	if err == nil || isProcessDone(err) {
+		return err
 	}
 
-	pflag.StringVarP(&timeoutSigStr, "signal", "s", "SIGTERM", "signal to send to wrapped process")
-	pflag.StringVarP(&timeoutStr, "before-timeout", "t", "60s", "time before build timeout to send designated signal; ex: 30s, 5m")
-	pflag.IntVarP(&timeoutExitCode, "timeout-exitcode", "e", 0, "non-zero exit code used if process is timed out; overrides process exit code")
-	pflag.BoolVarP(&quiet, "quiet", "q", false, "suppress all output except process stdout and stderr")
-	pflag.BoolVarP(&verbose, "verbose", "v", false, "enable additional logging")
-	help := pflag.BoolP("help", "h", false, "print this usage and exit")
+	if !quiet {
+		WarningLogger.Printf("Error sending %v to process, retrying: %v\n", signalName(sig), err.Error())
+	}
+	err = cmd.Signal(sig)
+	if err == nil || isProcessDone(err) || fallbackSigStr == "" {
+		return err
+	}
 
-	pflag.Parse()
+	if !quiet {
+		WarningLogger.Printf("Error sending %v to process, sending %v instead: %v\n", signalName(sig), fallbackSigStr, err.Error())
+	}
+	return cmd.Signal(validSignals[fallbackSigStr])
+}
 
-	if *help {
-		return 0, &UserRequestedHelp{}
+// runPreSignalHook runs hook with the shell, waiting up to timeout for it to finish. Its
+// failure is only logged, since the process must be signaled regardless.
+func runPreSignalHook(ctx context.Context, hook string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if verbose {
+		InfoLogger.Printf("Running pre-signal hook: %v\n", hook)
 	}
 
-	if len(pflag.Args()) < 3 {
-		return 1, errors.New(fmt.Sprintf("%v requires at least 3 positional arguments, got %v", os.Args[0], len(pflag.Args())))
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if jsonProcessOutput {
+		// the hook's output is written as JSON log entries, like the process's own
+		stdoutLines := &lineWriter{out: os.Stdout, maxLength: maxLineLength, stream: "stdout"}
+		stderrLines := &lineWriter{out: os.Stderr, maxLength: maxLineLength, stream: "stderr"}
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		cmd.Stdout, cmd.Stderr = stdoutLines, stderrLines
 	}
 
-	if _, ok := validSignals[timeoutSigStr]; !ok {
-		return 1, errors.New(fmt.Sprintf("%v is not a valid, catchable signal", timeoutSigStr))
+	if err := cmd.Run(); err != nil && !quiet {
+		if ctx.Err() == context.DeadlineExceeded {
+			WarningLogger.Printf("Pre-signal hook did not finish within %v\n", timeout)
+		} else {
+			WarningLogger.Printf("Pre-signal hook failed: %v\n", err.Error())
+		}
 	}
+}
 
-	dur, err := time.ParseDuration(timeoutStr)
+// startProcess starts the command in the background, returning it and a channel that
+// receives the result of running it.
+func startProcess(ctx context.Context, cmdName string, cmdArgs []string, stdout io.Writer, stderr io.Writer) (commandRunner, chan error, error) {
+	runner, err := newCommandRunner(ctx, cmdName, cmdArgs, stdout, stderr)
 	if err != nil {
-		return 1, errors.New(fmt.Sprintf("error with supplied value to --before-timeout: %v", err.Error()))
+		return nil, nil, err
 	}
-	timeoutDur = dur
 
-	projectId = pflag.Arg(0)
-	buildId = pflag.Arg(1)
-	cmdName = pflag.Arg(2)
-	cmdArgs = pflag.Args()[3:]
+	if verbose {
+		InfoLogger.Printf("Running command: %v %v", cmdName, strings.Join(redactArgs(cmdArgs), " "))
+	}
+	// started here rather than in the goroutine, so the process exists once this returns
+	// and can be signaled
+	if err := runner.Start(); err != nil {
+		return nil, nil, err
+	}
 
-	return 0, nil
+	done := make(chan error, 1)
+	go func() {
+		done <- runner.Wait()
+	}()
+
+	return runner, done, nil
 }
 
-func main() {
-	InfoLogger = log.New(os.Stdout, "INFO: ", log.LstdFlags)
-	WarningLogger = log.New(os.Stdout, "WARNING: ", log.LstdFlags)
-	ErrorLogger = log.New(os.Stderr, "ERROR: ", log.LstdFlags)
+// finishProcess cleans up after a process started by startProcess has exited.
+func finishProcess(runner commandRunner) {
+	switch r := runner.(type) {
+	case *execRunner:
+		r.finish()
+	case *parallelRunner:
+		for _, child := range r.children {
+			finishProcess(child)
+		}
+	}
+}
 
-	if exitCode, err := parseArgs(); err != nil {
-		pflag.Usage()
+func runCommand(ctx context.Context, cmdName string, cmdArgs []string, timeout time.Duration, sigChan chan os.Signal) error {
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	flushOutput := func() {}
 
-		if _, ok := err.(*UserRequestedHelp); !ok {
-			_, _ = fmt.Fprintf(os.Stderr, "%v\n", err.Error())
+	if timestampOutput || maxLineLength > 0 || jsonProcessOutput {
+		var format string
+		if timestampOutput {
+			format = timestampFormat
+		}
+		stdoutLines := &lineWriter{out: os.Stdout, timestampFormat: format, maxLength: maxLineLength}
+		stderrLines := &lineWriter{out: os.Stderr, timestampFormat: format, maxLength: maxLineLength}
+		if jsonProcessOutput {
+			stdoutLines.stream, stderrLines.stream = "stdout", "stderr"
+		}
+		flushOutput = func() {
+			_ = stdoutLines.Flush()
+			_ = stderrLines.Flush()
 		}
+		defer flushOutput()
+		stdout, stderr = stdoutLines, stderrLines
+	}
+
+	if teeFile != nil {
+		stdout = io.MultiWriter(stdout, teeFile)
+		stderr = io.MultiWriter(stderr, teeFile)
+	}
+
+	activity := &outputActivity{}
+	checkRate := maxOutputRate > 0 || maxOutputLineRate > 0
+	if escalateIfSilentDur > 0 || checkRate {
+		stdout, stderr = activity.wrap(stdout), activity.wrap(stderr)
+	}
 
-		os.Exit(exitCode)
+	if stdoutCopy != nil {
+		stdout = io.MultiWriter(stdout, stdoutCopy)
+	}
+	if stderrCopy != nil {
+		stderr = io.MultiWriter(stderr, stderrCopy)
 	}
+	if gcsLog != nil {
+		stdout = io.MultiWriter(stdout, gcsLog)
+		stderr = io.MultiWriter(stderr, gcsLog)
+	}
+
+	// cancelled to kill the process once --kill-after or --escalate-if-silent elapses, and on return
+	ctx, killProcess := context.WithCancel(ctx)
+	defer killProcess()
 
-	ctx := context.Background()
-	signalTime, err := getBuildSignalTime(ctx)
+	cmd, done, err := startProcess(ctx, cmdName, cmdArgs, stdout, stderr)
 	if err != nil {
-		ErrorLogger.Fatalln(err.Error())
+		return err
 	}
-	adjustedTimeout := signalTime.Sub(time.Now())
+	// cmd is replaced when the process is restarted, so always clean up the latest one
+	defer func() { finishProcess(cmd) }()
 
-	caughtSigsChan := make(chan os.Signal)
-	signal.Notify(caughtSigsChan)
-	// catch everything but SIGCHLD
-	// because we will have a child process this doesn't make sense to catch
-	signal.Reset(syscall.SIGCHLD)
+	// the warning and countdown follow the signal time, which --refresh-on-restart can move
+	var warnTimer *time.Timer
+	var stopCountdown chan struct{}
+	stopNotices := func() {
+		if warnTimer != nil {
+			warnTimer.Stop()
+			warnTimer = nil
+		}
+		if stopCountdown != nil {
+			close(stopCountdown)
+			stopCountdown = nil
+		}
+	}
+	defer stopNotices()
+	scheduleNotices := func() {
+		stopNotices()
+		if timeout == noSignalTimeout {
+			return
+		}
 
-	if err := runCommand(cmdName, cmdArgs, adjustedTimeout, caughtSigsChan); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode := exitError.ExitCode()
+		if warnBeforeDur > 0 {
+			warnAfter := timeout - warnBeforeDur
+			if warnAfter < 0 {
+				warnAfter = 0
+			}
+			warnTimer = time.AfterFunc(warnAfter, func() {
+				if !quiet {
+					WarningLogger.Printf("Process will be sent %v in %v\n", timeoutSigStr, warnBeforeDur)
+				}
+			})
+		}
+
+		if countdownIntervalDur > 0 {
+			stopCountdown = make(chan struct{})
+			go logCountdown(time.Now().Add(timeout), countdownIntervalDur, stopCountdown)
+		}
+	}
+	scheduleNotices()
 
+	var sentinel <-chan struct{}
+	if signalOnFile != "" {
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		sentinel = watchSentinelFile(signalOnFile, signalOnFileExisting == "immediate", stopWatching)
+	}
+
+	var buildEnded <-chan cloudbuildpb.Build_Status
+	if pollIntervalDur > 0 {
+		pollCtx, stopPolling := context.WithCancel(ctx)
+		defer stopPolling()
+		buildEnded = watchBuildStatus(pollCtx)
+	}
+
+	// earlier stages of an escalation schedule are sent ahead of the timeout signal by
+	// the difference in their leads
+	started := time.Now()
+	stageDelay := func(stage escalationStage) time.Duration {
+		return timeout - (stage.leadFor(buildTimeout) - beforeTimeoutLead(buildTimeout)) - time.Since(started)
+	}
+	nextStage := 0
+	var stageReached <-chan time.Time
+	var timeoutReached <-chan time.Time
+	scheduleSignals := func() {
+		nextStage, stageReached, timeoutReached = 0, nil, nil
+		if timeout == noSignalTimeout {
+			return
+		}
+		if len(escalationStages) > 0 {
+			stageReached = time.After(stageDelay(escalationStages[0]))
+		}
+		timeoutReached = time.After(timeout)
+	}
+	scheduleSignals()
+
+	var rateCheck <-chan time.Time
+	var lastBytes, lastLines int64
+	rateSignaled := false
+	if checkRate {
+		ticker := time.NewTicker(outputRateWindowDur)
+		defer ticker.Stop()
+		rateCheck = ticker.C
+	}
+
+	var signaledAt time.Time
+	var killAfter <-chan time.Time
+	var silenceCheck <-chan time.Time
+	// once the process has been signaled, --kill-after and --escalate-if-silent bound how
+	// long it has to exit before it is killed
+	startKillTimers := func() {
+		if killAfterDur > 0 && killAfter == nil {
+			killAfter = time.After(killAfterDur)
+		}
+		if escalateIfSilentDur > 0 && silenceCheck == nil {
+			silenceCheck = time.After(escalateIfSilentDur)
+		}
+	}
+	// with --diagnostic-signal, the process is given a chance to dump its state before
+	// it is killed
+	var diagnosticGrace <-chan time.Time
+	forceKill := func(reason string) {
+		killAfter, silenceCheck = nil, nil
+		if diagnosticSigStr != "" {
 			if !quiet {
-				WarningLogger.Printf("Process exited with non-zero exit code: %d\n", exitCode)
+				WarningLogger.Printf("%v; sending diagnostic signal %v to process, then %v in %v\n", reason, diagnosticSigStr, killSigStr, diagnosticGraceDur)
 			}
+			_ = cmd.Signal(validSignals[diagnosticSigStr])
+			diagnosticGrace = time.After(diagnosticGraceDur)
+			return
+		}
 
-			if processTimedOut && timeoutExitCode != 0 {
-				os.Exit(timeoutExitCode)
+		if !quiet {
+			WarningLogger.Printf("%v; sending %v signal to process\n", reason, killSigStr)
+		}
+		processKilled = true
+		killProcess()
+	}
+	// --pre-signal-hook runs in the background, so the process's output and exit and any
+	// signals are still handled meanwhile; hookDone is closed once it finishes or times out
+	var hookDone chan struct{}
+	defer func() {
+		// a hook still running when the process exits is stopped, not left behind
+		if hookDone != nil {
+			killProcess()
+			<-hookDone
+		}
+	}()
+	sendTimeoutSignal := func() {
+		signaledAt = time.Now()
+		_ = signalWithFallback(cmd, validSignals[timeoutSigStr])
+		if !quiet {
+			printTimeoutReport()
+		}
+		if verbose {
+			InfoLogger.Printf("Waiting on process to exit...")
+		}
+		startKillTimers()
+	}
+	forwarded := 0
+	restarting := false
+	// with --restart-cutoff, the process isn't restarted once the timeout signal is that close
+	nearTimeout := func() bool {
+		return restartCutoffDur > 0 && timeout != noSignalTimeout && timeout-time.Since(started) < restartCutoffDur
+	}
+
+	// with --forward-min-interval, signals arriving too soon after the last one forwarded
+	// are held back, and only the latest of them is forwarded once the interval is up
+	var lastForwardedAt time.Time
+	var pendingSig os.Signal
+	var forwardPending <-chan time.Time
+
+	for {
+		select {
+		case err := <-done:
+			if restarting && nearTimeout() {
+				restarting = false
+				processTimedOut = true
+				if !quiet {
+					WarningLogger.Printf("Process exited with %v; not restarting it this close to the timeout signal\n", err)
+				}
+			}
+			if restarting {
+				restarting = false
+				finishProcess(cmd)
+				if !quiet {
+					WarningLogger.Printf("Process exited with %v; restarting it\n", err)
+				}
+				if refreshOnRestart {
+					// the build is otherwise only fetched once, however often the process restarts
+					if newTimeout, err := refreshTimeout(ctx); err != nil {
+						if !quiet {
+							WarningLogger.Printf("Unable to refresh the build for --refresh-on-restart; keeping the current signal time: %v\n", err.Error())
+						}
+					} else {
+						timeout, started = newTimeout, time.Now()
+						scheduleNotices()
+						scheduleSignals()
+					}
+				}
+				newCmd, newDone, err := startProcess(ctx, cmdName, cmdArgs, stdout, stderr)
+				if err != nil {
+					return err
+				}
+				cmd, done = newCmd, newDone
+				continue
 			}
 
-			os.Exit(exitCode)
-		} else {
+			// write out any partial last line before logging anything about the exit
+			flushOutput()
+			if errors.Is(err, exec.ErrWaitDelay) {
+				// the process itself succeeded; only its output was cut short
+				if !quiet {
+					WarningLogger.Printf("Output of the process was still open %v after it exited; no longer waiting for it\n", childExitGraceDur)
+				}
+				err = nil
+			}
+			if !signaledAt.IsZero() && !quiet {
+				logFields(InfoLogger, "Process exited after being signaled", map[string]string{
+					"signal_to_exit_duration": logDuration(time.Since(signaledAt)),
+				})
+			}
+			return err
+		case recdSig := <-sigChan:
+			// signals keep being forwarded until the process exits, so that e.g. a second
+			// SIGINT can hurry along a process that is already shutting down
+			if preemptAware && recdSig == syscall.SIGTERM && signaledAt.IsZero() {
+				// a preempted worker VM is sent SIGTERM and shut down shortly after, whatever
+				// the build deadline, so shut down the same way as for the timeout
+				if !quiet {
+					WarningLogger.Printf("Parent process received %v, likely due to preemption; sending %v signal to process\n", signalName(recdSig), timeoutSigStr)
+				}
+				signaledAt = time.Now()
+				_ = signalWithFallback(cmd, validSignals[timeoutSigStr])
+				startKillTimers()
+			} else if restartSigStr != "" && recdSig == validSignals[restartSigStr] {
+				if processTimedOut || restarting {
+					if !quiet {
+						WarningLogger.Printf("Parent process received signal %v; ignoring restart request\n", recdSig.String())
+					}
+				} else if nearTimeout() {
+					// a restarted process would barely get going before being signaled anyway
+					if !quiet {
+						WarningLogger.Printf("Parent process received signal %v within --restart-cutoff of the timeout; sending %v signal to process instead of restarting it\n", recdSig.String(), timeoutSigStr)
+					}
+					processTimedOut = true
+					signaledAt = time.Now()
+					_ = signalWithFallback(cmd, validSignals[timeoutSigStr])
+					startKillTimers()
+				} else {
+					if !quiet {
+						WarningLogger.Printf("Parent process received signal %v; sending %v to child command process to restart it\n", recdSig.String(), signalStr)
+					}
+					restarting = true
+					_ = cmd.Signal(validSignals[signalStr])
+				}
+			} else if upgradeFirstSignal && forwarded == 0 && recdSig != validSignals[signalStr] {
+				if !quiet {
+					WarningLogger.Printf("Parent process received signal %v; sending %v to child command process instead\n", recdSig.String(), signalStr)
+				}
+				_ = cmd.Signal(validSignals[signalStr])
+			} else if wait := forwardMinIntervalDur - time.Since(lastForwardedAt); forwardMinIntervalDur > 0 && wait > 0 {
+				if !quiet {
+					WarningLogger.Printf("Parent process received signal %v; delaying forwarding by %v\n", recdSig.String(), wait)
+				}
+				pendingSig = recdSig
+				if forwardPending == nil {
+					forwardPending = time.After(wait)
+				}
+			} else {
+				if !quiet {
+					WarningLogger.Printf("Parent process received signal %v; forwarding to child command process\n", recdSig.String())
+				}
+				_ = cmd.Signal(recdSig)
+				lastForwardedAt = time.Now()
+			}
+			forwarded++
+		case <-forwardPending:
 			if !quiet {
-				ErrorLogger.Println(err.Error())
+				WarningLogger.Printf("Forwarding delayed signal %v to child command process\n", pendingSig.String())
+			}
+			_ = cmd.Signal(pendingSig)
+			lastForwardedAt = time.Now()
+			pendingSig = nil
+			forwardPending = nil
+		case <-sentinel:
+			if !quiet {
+				WarningLogger.Printf("File %v was created; sending %v signal to process\n", signalOnFile, signalStr)
+			}
+			_ = cmd.Signal(validSignals[signalStr])
+			sentinel = nil
+		case status := <-buildEnded:
+			buildEnded = nil
+			if !signaledAt.IsZero() {
+				if !quiet {
+					WarningLogger.Printf("Build status is now %v; process was already sent %v\n", status, timeoutSigStr)
+				}
+				continue
+			}
+			if !quiet {
+				WarningLogger.Printf("Build status is now %v; sending %v signal to process\n", status, timeoutSigStr)
+			}
+			signaledAt = time.Now()
+			_ = signalWithFallback(cmd, validSignals[timeoutSigStr])
+			startKillTimers()
+		case <-stageReached:
+			stage := escalationStages[nextStage]
+			nextStage++
+			stageReached = nil
+			if nextStage < len(escalationStages) {
+				stageReached = time.After(stageDelay(escalationStages[nextStage]))
+			}
+			if !signaledAt.IsZero() {
+				continue
+			}
+			if !quiet {
+				WarningLogger.Printf("Build timeout is %v away; sending %v signal to process\n", stage.leadFor(buildTimeout), stage.signal)
+			}
+			_ = cmd.Signal(validSignals[stage.signal])
+		case <-timeoutReached:
+			if !signaledAt.IsZero() {
+				// the timeout signal is only ever sent once, whatever triggers it
+				if !quiet {
+					WarningLogger.Printf("Timeout has been reached; process was already sent %v\n", timeoutSigStr)
+				}
+				processTimedOut = true
+				continue
+			}
+			if hookDone != nil {
+				// the signal is sent once the hook already running finishes
+				continue
+			}
+			if !quiet {
+				WarningLogger.Printf("Timeout has been reached; sending %v signal to process", timeoutSigStr)
+			}
+			if notifyURL != "" {
+				notifySignal(notifyURL, timeoutSigStr)
+			}
+			processTimedOut = true
+			if preSignalHook != "" {
+				hookDone = make(chan struct{})
+				go func(done chan struct{}) {
+					defer close(done)
+					runPreSignalHook(ctx, preSignalHook, preSignalHookTimeoutDur)
+				}(hookDone)
+				continue
+			}
+			sendTimeoutSignal()
+		case <-hookDone:
+			hookDone = nil
+			sendTimeoutSignal()
+		case <-killAfter:
+			forceKill(fmt.Sprintf("Process did not exit within %v of being signaled", killAfterDur))
+		case <-silenceCheck:
+			// silence only counts from when the process was signaled
+			quietSince := activity.lastOutput()
+			if quietSince.Before(signaledAt) {
+				quietSince = signaledAt
+			}
+			if wait := escalateIfSilentDur - time.Since(quietSince); wait > 0 {
+				silenceCheck = time.After(wait)
+				continue
+			}
+			forceKill(fmt.Sprintf("Process has written no output for %v since being signaled", escalateIfSilentDur))
+		case <-rateCheck:
+			written, lines := activity.written()
+			byteRate := float64(written-lastBytes) / outputRateWindowDur.Seconds()
+			lineRate := float64(lines-lastLines) / outputRateWindowDur.Seconds()
+			lastBytes, lastLines = written, lines
+			if (maxOutputRate == 0 || byteRate <= float64(maxOutputRate)) && (maxOutputLineRate == 0 || lineRate <= float64(maxOutputLineRate)) {
+				continue
 			}
 
-			if processTimedOut && timeoutExitCode != 0 {
-				os.Exit(timeoutExitCode)
+			if !quiet {
+				WarningLogger.Printf("Process is writing output too fast: %.0f bytes/s and %.0f lines/s over the last %v\n", byteRate, lineRate, outputRateWindowDur)
+			}
+			if outputRateSigStr != "" && !rateSignaled {
+				if !quiet {
+					WarningLogger.Printf("Sending %v signal to process for its output rate\n", outputRateSigStr)
+				}
+				rateSignaled = true
+				_ = cmd.Signal(validSignals[outputRateSigStr])
+			}
+		case <-diagnosticGrace:
+			if !quiet {
+				WarningLogger.Printf("Process did not exit within %v of the diagnostic signal; sending %v signal to process\n", diagnosticGraceDur, killSigStr)
 			}
+			diagnosticGrace = nil
+			processKilled = true
+			killProcess()
+		}
+	}
+}
 
-			os.Exit(1)
+// logCountdown logs how long the build has been running and the time left until
+// signalTime every interval, until it is reached or stop is closed.
+func logCountdown(signalTime time.Time, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
 		}
-	} else {
-		if verbose {
-			InfoLogger.Println("Process exited successfully")
+
+		now := time.Now()
+		remaining := signalTime.Sub(now)
+		if remaining <= 0 {
+			return
+		}
+		if !quiet {
+			elapsed := buildTimeout - buildDeadline.Sub(now)
+			InfoLogger.Printf("Build has been running for %v; %v until the process is sent %v\n", elapsed.Round(time.Second), remaining.Round(time.Second), timeoutSigStr)
+		}
+	}
+}
+
+// watchSentinelFile polls for path to be created, closing the returned channel when it is.
+// If the file already exists, the channel is closed immediately when triggerIfExists is set;
+// otherwise the file must first be removed and then created again.
+func watchSentinelFile(path string, triggerIfExists bool, stop <-chan struct{}) <-chan struct{} {
+	created := make(chan struct{})
+
+	go func() {
+		_, err := os.Stat(path)
+		existed := err == nil && !triggerIfExists
+
+		ticker := time.NewTicker(sentinelPollInterval)
+		defer ticker.Stop()
+
+		for {
+			_, err := os.Stat(path)
+			exists := err == nil
+			if exists && !existed {
+				close(created)
+				return
+			}
+			existed = exists
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return created
+}
+
+// watchBuildStatus polls the build, waiting pollDelay between polls, until ctx is
+// cancelled, sending its status on the returned channel once the build has been
+// cancelled or timed out.
+func watchBuildStatus(ctx context.Context) <-chan cloudbuildpb.Build_Status {
+	ended := make(chan cloudbuildpb.Build_Status, 1)
+
+	go func() {
+		// one client is created on the first poll and reused for the rest, rather than
+		// repeating the credential wait and connectivity check every time
+		var c *cloudbuild.Client
+		defer func() {
+			if c != nil {
+				c.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-time.After(pollDelay(time.Now())):
+			case <-ctx.Done():
+				return
+			}
+
+			var resp *cloudbuildpb.Build
+			var err error
+			if buildInfoFile != "" {
+				resp, err = readBuildFile(buildInfoFile)
+			} else {
+				if c == nil {
+					c, err = newBuildClient(ctx)
+				}
+				if err == nil {
+					resp, err = fetchBuild(ctx, c)
+				}
+			}
+			if err != nil {
+				if verbose {
+					InfoLogger.Printf("Unable to poll build status: %v\n", err.Error())
+				}
+				continue
+			}
+
+			if resp.Status == cloudbuildpb.Build_CANCELLED || resp.Status == cloudbuildpb.Build_TIMEOUT {
+				ended <- resp.Status
+				return
+			}
+		}
+	}()
+
+	return ended
+}
+
+// pollDelay returns how long to wait before polling the build again: --poll-interval, or
+// with --poll-interval-max, a tenth of the time left until the build deadline kept between
+// the two, so that a long build is polled less often until its deadline nears.
+func pollDelay(now time.Time) time.Duration {
+	if pollIntervalMaxDur <= pollIntervalDur {
+		return pollIntervalDur
+	}
+
+	delay := buildDeadline.Sub(now) / 10
+	if delay < pollIntervalDur {
+		return pollIntervalDur
+	}
+	if delay > pollIntervalMaxDur {
+		return pollIntervalMaxDur
+	}
+	return delay
+}
+
+// redactArgs returns a copy of args for logging, with values matching --redact-args masked.
+// For KEY=VALUE arguments only the value is masked, and a flag that would match as
+// --flag=VALUE has the argument following it masked, as in --password VALUE.
+func redactArgs(args []string) []string {
+	if redactPattern == nil {
+		return args
+	}
+
+	redacted := make([]string, len(args))
+	maskNext := false
+	for i, arg := range args {
+		switch {
+		case maskNext:
+			redacted[i] = redactedValue
+			maskNext = false
+		case strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") && redactPattern.MatchString(arg+"="):
+			redacted[i] = arg
+			maskNext = true
+		case !redactPattern.MatchString(arg):
+			redacted[i] = arg
+		case strings.Contains(arg, "="):
+			redacted[i] = arg[:strings.Index(arg, "=")+1] + redactedValue
+		default:
+			redacted[i] = redactedValue
 		}
+	}
+
+	return redacted
+}
+
+// printTimeoutReport tells whoever is reading the build log, in plain words, that the
+// command was cut short by the build deadline rather than failing on its own.
+func printTimeoutReport() {
+	report := []string{fmt.Sprintf("The Cloud Build timeout for build %v is about to be reached.", buildId)}
+	if stepName != "" {
+		report[0] = fmt.Sprintf("The Cloud Build timeout for build %v, step %v, is about to be reached.", buildId, stepName)
+	}
+	report = append(report,
+		fmt.Sprintf("%v was sent to '%v' so it can shut down before the build is force-terminated.", timeoutSigStr, cmdName),
+		"If this step fails, it is because it ran out of time, not because the command failed on its own.")
+
+	if jsonProcessOutput {
+		// a single entry, so that stderr stays NDJSON
+		_ = (&jsonLogWriter{out: os.Stderr, severity: "WARNING"}).writeEntry(strings.Join(report, " "), nil)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "\n*** %v\n\n", strings.Join(report, "\n*** "))
+}
+
+// logChildExitDetails logs the exit status and resource usage of the exited child process.
+func logChildExitDetails(state *os.ProcessState) {
+	if quiet {
+		return
+	}
+
+	fields := map[string]string{
+		"pid":             strconv.Itoa(state.Pid()),
+		"exit_status":     state.String(),
+		"user_cpu_time":   logDuration(state.UserTime()),
+		"system_cpu_time": logDuration(state.SystemTime()),
+	}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		fields["max_rss_kib"] = strconv.FormatInt(int64(rusage.Maxrss), 10)
+	}
+
+	logFields(InfoLogger, "Child process exited", fields)
+}
+
+// isTransientAPIError reports whether a Cloud Build API call that failed with err
+// may succeed if retried.
+func isTransientAPIError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+
+	return false
+}
+
+// getBuild retrieves the build from the Cloud Build API, or from --build-info-file when set.
+// With useCache, a fresh --build-info-cache-file is used in place of the API.
+func getBuild(ctx context.Context, useCache bool) (*cloudbuildpb.Build, error) {
+	if buildInfoFile != "" {
+		return readBuildFile(buildInfoFile)
+	}
 
-		if processTimedOut && timeoutExitCode != 0 {
-			os.Exit(timeoutExitCode)
+	if useCache && buildInfoCacheFile != "" {
+		if build := readBuildInfoCache(buildInfoCacheFile, buildInfoCacheTTLDur); build != nil {
+			return build, nil
 		}
 	}
+
+	c, err := newBuildClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resp, err := fetchBuild(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if buildInfoCacheFile != "" {
+		if err := writeBuildInfoCache(buildInfoCacheFile, resp); err != nil && !quiet {
+			WarningLogger.Printf("Unable to write build info cache file: %v\n", err.Error())
+		}
+	}
+
+	return resp, nil
+}
+
+// newBuildClient creates a Cloud Build API client, after waiting for credentials and
+// checking connectivity as configured.
+func newBuildClient(ctx context.Context) (*cloudbuild.Client, error) {
+	if waitForCredsDur > 0 {
+		if err := waitForCredentials(ctx, waitForCredsDur); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := defaultAPIEndpoint
+	if apiEndpoint != "" {
+		endpoint = apiEndpoint
+	} else if region != "" {
+		// regional builds are only visible through the region's own API endpoint
+		endpoint = fmt.Sprintf("%s-cloudbuild.googleapis.com:443", region)
+	}
+
+	if checkConnectivityFlag {
+		if err := checkConnectivity(ctx, endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	var opts []option.ClientOption
+	if endpoint != defaultAPIEndpoint {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	if apiInsecure {
+		// for emulators, which speak plaintext and don't check credentials
+		opts = append(opts, option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	}
+
+	if apiTimeoutDur > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, apiTimeoutDur)
+		defer cancel()
+	}
+
+	c, err := cloudbuild.NewClient(ctx, opts...)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.New(fmt.Sprintf("timed out creating Cloud Build client after --api-timeout of %v", apiTimeoutDur))
+		}
+		return nil, errors.New(fmt.Sprintf("Error creating Cloud Build client: %v", err.Error()))
+	}
+
+	return c, nil
+}
+
+// fetchBuild gets the build from the API with c, retrying transient errors.
+func fetchBuild(ctx context.Context, c *cloudbuild.Client) (*cloudbuildpb.Build, error) {
+	if verbose {
+		InfoLogger.Println("Getting build info from Cloud Build API")
+	}
+
+	if apiTimeoutDur > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, apiTimeoutDur)
+		defer cancel()
+	}
+
+	req := &cloudbuildpb.GetBuildRequest{
+		ProjectId: projectId,
+		Id:        buildId,
+	}
+	if region != "" {
+		req.Name = fmt.Sprintf("projects/%s/locations/%s/builds/%s", projectId, region, buildId)
+	}
+
+	var resp *cloudbuildpb.Build
+	var err error
+	attempts := 0
+	backoff := apiRetryBackoff
+	for {
+		attempts++
+		resp, err = c.GetBuild(ctx, req)
+		if err == nil || !isTransientAPIError(err) || attempts > apiRetries || ctx.Err() != nil {
+			break
+		}
+
+		if !quiet {
+			WarningLogger.Printf("Transient error getting build from API, retrying in %v: %v\n", backoff, err.Error())
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.New(fmt.Sprintf("timed out getting build from API after --api-timeout of %v and %d attempt(s): %v", apiTimeoutDur, attempts, err.Error()))
+		}
+		if status.Code(err) == codes.Unauthenticated {
+			return nil, errors.New(fmt.Sprintf("error getting build from API after %d attempt(s); credentials are invalid: %v", attempts, err.Error()))
+		}
+		return nil, errors.New(fmt.Sprintf("error getting build from API after %d attempt(s); check project and build ID: %v; ", attempts, err.Error()))
+	}
+
+	return resp, nil
+}
+
+// readBuildFile reads a build from a JSON file in the Cloud Build API's format, as
+// written by e.g. gcloud builds describe --format=json.
+func readBuildFile(path string) (*cloudbuildpb.Build, error) {
+	if verbose {
+		InfoLogger.Printf("Reading build info from file %v\n", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error reading build info file: %v", err.Error()))
+	}
+
+	build := &cloudbuildpb.Build{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, build); err != nil {
+		return nil, errors.New(fmt.Sprintf("error parsing build info file: %v", err.Error()))
+	}
+
+	// unknown keys are discarded, so a misspelled field would otherwise go unnoticed
+	if deadlineBase == "create" && build.CreateTime == nil {
+		return nil, errors.New(fmt.Sprintf("build info file %v has no createTime", path))
+	} else if deadlineBase != "create" && build.StartTime == nil {
+		return nil, errors.New(fmt.Sprintf("build info file %v has no startTime", path))
+	}
+	if build.Timeout == nil {
+		return nil, errors.New(fmt.Sprintf("build info file %v has no timeout", path))
+	}
+
+	return build, nil
+}
+
+// reconcileBuildStatus warns when the outcome of the process disagrees with the
+// status Cloud Build currently reports for the build. A build that is still running, as
+// it is while its own steps run, isn't compared.
+func reconcileBuildStatus(ctx context.Context, processSucceeded bool) {
+	resp, err := getBuild(ctx, false)
+	if err != nil {
+		if !quiet {
+			WarningLogger.Printf("Unable to reconcile process outcome with build status: %v\n", err.Error())
+		}
+		return
+	}
+
+	var mismatch bool
+	switch resp.Status {
+	case cloudbuildpb.Build_SUCCESS:
+		mismatch = !processSucceeded
+	case cloudbuildpb.Build_FAILURE, cloudbuildpb.Build_INTERNAL_ERROR, cloudbuildpb.Build_TIMEOUT,
+		cloudbuildpb.Build_CANCELLED, cloudbuildpb.Build_EXPIRED:
+		mismatch = processSucceeded
+	case cloudbuildpb.Build_WORKING, cloudbuildpb.Build_QUEUED, cloudbuildpb.Build_PENDING:
+		// the status of a build running this very step only settles after the step
+		// finishes, so there is nothing to compare against yet
+		if verbose {
+			InfoLogger.Printf("Build status is %v; it is still running, so the outcome can't be reconciled yet\n", resp.Status)
+		}
+		return
+	}
+
+	if mismatch && !quiet {
+		WarningLogger.Printf("Process succeeded: %v, but build status is %v\n", processSucceeded, resp.Status)
+	} else if verbose {
+		InfoLogger.Printf("Build status is %v\n", resp.Status)
+	}
+}
+
+// checkTimingBudget returns an error if the configured grace periods can't all fit
+// within the build timeout.
+func checkTimingBudget(buildTimeout time.Duration, lead time.Duration) error {
+	budget := lead + jitterDur + killGrace()
+	if budget >= buildTimeout {
+		killFlags := "--kill-after"
+		if killGrace() != killAfterDur {
+			killFlags = "--kill-after and --diagnostic-grace"
+		}
+		return errors.New(fmt.Sprintf("--before-timeout (%v) plus --signal-time-jitter (%v) plus %v (%v) do not fit within the build timeout of %v", lead, jitterDur, killFlags, killGrace(), buildTimeout))
+	}
+
+	return nil
+}
+
+// killGrace returns how long the process has to exit after the timeout signal before it
+// is killed: --kill-after, plus --diagnostic-grace if --diagnostic-signal is sent first.
+func killGrace() time.Duration {
+	if killAfterDur > 0 && diagnosticSigStr != "" {
+		return killAfterDur + diagnosticGraceDur
+	}
+	return killAfterDur
+}
+
+// refreshTimeout fetches the build again for --refresh-on-restart, returning how long
+// until the restarted process should be signaled. It is replaced in tests.
+var refreshTimeout = func(ctx context.Context) (time.Duration, error) {
+	signalTime, err := getSignalTime(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if signalTime == nil {
+		return noSignalTimeout, nil
+	}
+
+	delayed := minRuntimeSignalTime(*signalTime, time.Now())
+	logSignalTime = delayed
+	return time.Until(delayed), nil
+}
+
+func getBuildSignalTime(ctx context.Context) (*time.Time, error) {
+	requestStart := time.Now()
+	resp, err := getBuild(ctx, true)
+	if err != nil {
+		return nil, &BuildUnavailable{Err: err}
+	}
+	apiLatency := time.Since(requestStart)
+
+	if verbose {
+		InfoLogger.Printf("Build info retrieved in %v\n", apiLatency)
+	}
+
+	if resp.Timeout == nil || resp.Timeout.AsDuration() <= 0 {
+		if !quiet {
+			WarningLogger.Printf("Build %v has no timeout; the process will not be signaled ahead of one\n", shortBuildId())
+		}
+		return nil, nil
+	}
+
+	base := resp.StartTime
+	if deadlineBase == "create" {
+		base = resp.CreateTime
+	}
+	if base == nil {
+		return nil, errors.New(fmt.Sprintf("build %v has no %v time to measure the timeout from", shortBuildId(), deadlineBase))
+	}
+
+	buildTimeoutTime := base.Seconds + resp.Timeout.Seconds
+	buildDeadline = time.Unix(buildTimeoutTime, 0)
+	buildTimeout = resp.Timeout.AsDuration()
+
+	if value, ok := resp.Substitutions[deadlineSubstitution]; ok && deadlineSubstitution != "" {
+		deadline, err := parseDeadlineSubstitution(value, base.AsTime())
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid deadline in substitution %v: %v", deadlineSubstitution, err.Error()))
+		}
+
+		if deadline.After(buildDeadline) && !quiet {
+			WarningLogger.Printf("Deadline from substitution %v is after the build timeout at %v\n", deadlineSubstitution, buildDeadline)
+		}
+		if verbose {
+			InfoLogger.Printf("Using deadline %v from substitution %v\n", deadline, deadlineSubstitution)
+		}
+
+		buildDeadline = deadline
+		buildTimeout = deadline.Sub(base.AsTime())
+	}
+
+	// buildTimeout is what's left of the timeout once any --deadline-from-substitution is applied
+	lead := signalLead(buildTimeout, buildDeadline, time.Now())
+
+	if err := checkTimingBudget(buildTimeout, lead); err != nil {
+		if !allowTightTiming {
+			return nil, err
+		}
+		if !quiet {
+			WarningLogger.Println(err.Error())
+		}
+	}
+
+	signalTime := buildDeadline.Add(-lead)
+
+	if signalTime.Before(time.Now()) {
+		if minRuntimeDur <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid signal time '%v' for build ID '%v': occurs in the past", signalTime, shortBuildId()))
+		}
+		// minRuntimeSignalTime moves it to --min-runtime from now, within the deadline
+		if !quiet {
+			WarningLogger.Printf("Signal time %v has already passed; the process will get --min-runtime of %v\n", signalTime, minRuntimeDur)
+		}
+	}
+
+	if autoSafetyMargin {
+		// the API's response time is a rough guide to how late we may be in reacting, so
+		// allow for it happening again on top of what it has already cost us
+		margin := (apiLatency * safetyMarginFactor).Round(time.Millisecond)
+		signalTime = signalTime.Add(-margin)
+		if !quiet {
+			InfoLogger.Printf("Applied safety margin of %v for API latency of %v\n", margin, apiLatency.Round(time.Millisecond))
+		}
+	}
+
+	if jitterDur > 0 {
+		signalTime = jitterSignalTime(signalTime, jitterDur, time.Now())
+	}
+
+	if verbose {
+		InfoLogger.Printf("Cloud Build timeout is %v seconds\n", resp.Timeout.Seconds)
+		InfoLogger.Printf("Cloud Build container will be terminated at %v\n", time.Unix(buildTimeoutTime, 0))
+		InfoLogger.Printf("Process will be signaled at %v\n", signalTime)
+	}
+
+	return &signalTime, nil
+}
+
+// parseDeadlineSubstitution parses the value of the --deadline-from-substitution
+// substitution, either an RFC 3339 time or a duration measured from base.
+func parseDeadlineSubstitution(value string, base time.Time) (time.Time, error) {
+	if deadline, err := time.Parse(time.RFC3339, value); err == nil {
+		return deadline, nil
+	}
+
+	dur, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("%q is neither an RFC 3339 time nor a duration", value))
+	}
+
+	return base.Add(dur), nil
+}
+
+// shortBuildId returns the build ID shortened to --short-id-length characters for logs.
+func shortBuildId() string {
+	if len(buildId) <= shortIdLength {
+		return buildId
+	}
+
+	return buildId[:shortIdLength]
+}
+
+// getSignalTime computes the signal time from the build and --fallback-timeout, as
+// --timeout-combine-policy says, leaving buildDeadline and buildTimeout set to match.
+func getSignalTime(ctx context.Context, now time.Time) (*time.Time, error) {
+	if fallbackTimeoutDur == 0 {
+		return getBuildSignalTime(ctx)
+	}
+	if timeoutCombinePolicy == "fixed-preferred" {
+		return getFallbackSignalTime(now)
+	}
+
+	apiTime, err := getBuildSignalTime(ctx)
+	if _, ok := err.(*BuildUnavailable); ok {
+		if !quiet {
+			WarningLogger.Printf("Operating in fallback mode, assuming a build timeout of %v from now: %v\n", fallbackTimeoutDur, err.Error())
+		}
+		return getFallbackSignalTime(now)
+	}
+	if err != nil || timeoutCombinePolicy == "api-preferred" {
+		return apiTime, err
+	}
+
+	apiDeadline, apiTimeout := buildDeadline, buildTimeout
+	fixedTime, err := getFallbackSignalTime(now)
+	if err != nil {
+		return nil, err
+	}
+
+	// a build without a timeout is never signaled, which is as late as it gets
+	useFixed := apiTime == nil || fixedTime.Before(*apiTime)
+	if timeoutCombinePolicy == "max" {
+		useFixed = apiTime != nil && fixedTime.After(*apiTime)
+	}
+	if !useFixed {
+		buildDeadline, buildTimeout = apiDeadline, apiTimeout
+		return apiTime, nil
+	}
+
+	if verbose {
+		InfoLogger.Printf("Using the signal time from --fallback-timeout under --timeout-combine-policy=%v\n", timeoutCombinePolicy)
+	}
+	return fixedTime, nil
+}
+
+// getFallbackSignalTime computes the signal time from --fallback-timeout, for use when
+// the build can't be retrieved or --timeout-combine-policy prefers it.
+func getFallbackSignalTime(now time.Time) (*time.Time, error) {
+	// without its monotonic clock reading, which would otherwise show up in --dry-run
+	buildDeadline = now.Add(fallbackTimeoutDur).Round(0)
+	buildTimeout = fallbackTimeoutDur
+
+	lead := signalLead(fallbackTimeoutDur, buildDeadline, now)
+	if err := checkTimingBudget(fallbackTimeoutDur, lead); err != nil && !allowTightTiming {
+		return nil, err
+	}
+	signalTime := buildDeadline.Add(-lead)
+
+	if verbose {
+		InfoLogger.Printf("Process will be signaled at %v\n", signalTime)
+	}
+
+	return &signalTime, nil
+}
+
+// minRuntimeSignalTime delays signalTime so the process runs at least --min-runtime from now,
+// but never past the build deadline less the time it is given before being killed.
+func minRuntimeSignalTime(signalTime, now time.Time) time.Time {
+	earliest := now.Add(minRuntimeDur)
+	if minRuntimeDur <= 0 || !signalTime.Before(earliest) {
+		return signalTime
+	}
+
+	if latest := buildDeadline.Add(-killGrace()); earliest.After(latest) {
+		if !quiet {
+			WarningLogger.Printf("--min-runtime of %v would signal the process after the build deadline less --kill-after; signaling at %v instead\n", minRuntimeDur, latest)
+		}
+		earliest = latest
+	}
+	if !signalTime.Before(earliest) {
+		return signalTime
+	}
+
+	if !quiet {
+		WarningLogger.Printf("Signal time leaves the process less than --min-runtime of %v; delaying the signal by %v\n", minRuntimeDur, earliest.Sub(signalTime).Round(time.Millisecond))
+	}
+	return earliest
+}
+
+// beforeTimeoutLead returns how long before a build with the given timeout to signal the
+// process, according to --before-timeout.
+func beforeTimeoutLead(buildTimeout time.Duration) time.Duration {
+	if timeoutPercent > 0 {
+		return time.Duration(float64(buildTimeout) * timeoutPercent / 100)
+	}
+
+	return timeoutDur
+}
+
+// clampLead restricts how long before the build timeout the process is signaled to
+// the range set by --min-lead and --max-lead, warning if it had to be changed.
+func clampLead(lead time.Duration) time.Duration {
+	clamped := lead
+	if minLeadDur > 0 && clamped < minLeadDur {
+		clamped = minLeadDur
+	}
+	if maxLeadDur > 0 && clamped > maxLeadDur {
+		clamped = maxLeadDur
+	}
+
+	if clamped != lead && !quiet {
+		WarningLogger.Printf("Signal lead time of %v is outside the allowed range; using %v\n", lead, clamped)
+	}
+
+	return clamped
+}
+
+// jitterSignalTime moves signalTime earlier by a random amount of up to window,
+// so that parallel steps sharing a build deadline don't all signal at once.
+// The result is never later than signalTime nor earlier than now.
+func jitterSignalTime(signalTime time.Time, window time.Duration, now time.Time) time.Time {
+	if remaining := signalTime.Sub(now); remaining < window {
+		window = remaining
+	}
+	if window <= 0 {
+		return signalTime
+	}
+
+	rng := rand.New(rand.NewSource(now.UnixNano()))
+	jittered := signalTime.Add(-time.Duration(rng.Int63n(int64(window))))
+
+	if verbose {
+		InfoLogger.Printf("Signal time jittered by %v\n", signalTime.Sub(jittered))
+	}
+
+	return jittered
+}
+
+// logScheduleSummary logs the build timeout, how much of it has been used and
+// remains, and when the process will be signaled, on a single line.
+func logScheduleSummary(now time.Time, signalTime time.Time) {
+	remaining := buildDeadline.Sub(now)
+	InfoLogger.Printf("Build timeout %v, elapsed %v, remaining %v; will signal %v in %v\n",
+		buildTimeout, (buildTimeout - remaining).Round(time.Second), remaining.Round(time.Second),
+		timeoutSigStr, signalTime.Sub(now).Round(time.Second))
+}
+
+// checkDirectory returns an error unless dir exists and is a directory.
+func checkDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(fmt.Sprintf("%v is not a directory", dir))
+	}
+	return nil
+}
+
+// checkWritable returns an error unless path can be written to, without creating or modifying it.
+func checkWritable(path string) error {
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return errors.New(fmt.Sprintf("%v is a directory", path))
+		}
+		// opening without O_TRUNC leaves the contents alone
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// a new file needs a directory it can be created in
+	dir := filepath.Dir(path)
+	if err := checkDirectory(dir); err != nil {
+		return err
+	}
+	// W_OK|X_OK, which the syscall package doesn't define
+	return syscall.Access(dir, 0x2|0x1)
+}
+
+// printSchedule prints the build timeout and when the process would be signaled, for --dry-run.
+func printSchedule(now time.Time, signalTime *time.Time) {
+	if signalTime == nil {
+		fmt.Println("Build timeout: none")
+		fmt.Println("Signal time: none; the process would not be signaled")
+		return
+	}
+
+	fmt.Printf("Build timeout: %v\n", buildTimeout)
+	fmt.Printf("Build deadline: %v\n", buildDeadline)
+	fmt.Printf("Signal time: %v (%v before the deadline)\n", *signalTime, buildDeadline.Sub(*signalTime))
+	fmt.Printf("Wait before signaling: %v\n", signalTime.Sub(now).Round(time.Millisecond))
+}
+
+// signalLead returns how long before deadline to signal the process, according to
+// --signal-at-remaining-percent if set and --before-timeout otherwise, limited by
+// --min-lead and --max-lead.
+func signalLead(buildTimeout time.Duration, deadline time.Time, now time.Time) time.Duration {
+	if remainingPercent > 0 {
+		lead := time.Duration(float64(deadline.Sub(now)) * remainingPercent / 100)
+		if verbose {
+			InfoLogger.Printf("Signaling with %v%% of remaining time left, %v before the deadline\n", remainingPercent, lead)
+		}
+		return clampLead(lead)
+	}
+
+	return clampLead(beforeTimeoutLead(buildTimeout))
+}
+
+// writeExportFile writes the build deadline and signal time to path as shell
+// export statements, so that later commands in a shell step can source it.
+func writeExportFile(path string, deadline time.Time, signalTime time.Time) error {
+	contents := fmt.Sprintf("export WRAPPER_DEADLINE='%s'\n", deadline.UTC().Format(time.RFC3339)) +
+		fmt.Sprintf("export WRAPPER_DEADLINE_UNIX=%d\n", deadline.Unix()) +
+		fmt.Sprintf("export WRAPPER_SIGNAL_TIME='%s'\n", signalTime.UTC().Format(time.RFC3339)) +
+		fmt.Sprintf("export WRAPPER_SIGNAL_TIME_UNIX=%d\n", signalTime.Unix())
+
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		return errors.New(fmt.Sprintf("error writing export file: %v", err.Error()))
+	}
+
+	if verbose {
+		InfoLogger.Printf("Wrote deadline exports to %v\n", path)
+	}
+
+	return nil
+}
+
+// applyAlias loads the flag presets in aliasFile and applies those of the named alias
+// that weren't explicitly set on the command line. The file is a JSON object mapping
+// alias names to objects of flag names and values, e.g. {"maven": {"signal": "SIGTERM"}}.
+func applyAlias(aliasFile string, name string) error {
+	if aliasFile == "" {
+		return errors.New("--alias requires --alias-file")
+	}
+
+	data, err := ioutil.ReadFile(aliasFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error reading alias file: %v", err.Error()))
+	}
+
+	var aliases map[string]map[string]string
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return errors.New(fmt.Sprintf("error parsing alias file: %v", err.Error()))
+	}
+
+	preset, ok := aliases[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("alias '%v' not found in %v", name, aliasFile))
+	}
+
+	for flagName, value := range preset {
+		f := pflag.Lookup(flagName)
+		if f == nil {
+			return errors.New(fmt.Sprintf("alias '%v' sets unknown flag --%v", name, flagName))
+		}
+		if f.Changed {
+			continue
+		}
+		if err := pflag.Set(flagName, value); err != nil {
+			return errors.New(fmt.Sprintf("alias '%v' sets invalid value for --%v: %v", name, flagName, err.Error()))
+		}
+		if verbose {
+			InfoLogger.Printf("Alias %v set --%v=%v\n", name, flagName, value)
+		}
+	}
+
+	return nil
+}
+
+// timedOutExitCode returns the exit code to use in place of the process's own after it
+// was signaled for the timeout, if one was configured.
+func timedOutExitCode() (int, bool) {
+	if !processTimedOut {
+		return 0, false
+	}
+
+	if gracefulExitCode >= 0 && !processKilled {
+		return gracefulExitCode, true
+	}
+
+	if timeoutExitCode != 0 {
+		return timeoutExitCode, true
+	}
+
+	return 0, false
+}
+
+// startErrorExitCode maps an error starting the process to the exit code a shell would
+// use: 127 if the command wasn't found, 126 if it couldn't be executed.
+func startErrorExitCode(err error) (int, bool) {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, syscall.ENOENT):
+		return 127, true
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.ENOEXEC), errors.Is(err, syscall.EISDIR):
+		return 126, true
+	}
+
+	return 0, false
+}
+
+// exit records code in --exit-code-file, when set, and exits the wrapper with it.
+func exit(code int) {
+	if cancelMain != nil {
+		// stops anything still working on the wrapper's behalf, such as the status poller
+		cancelMain()
+	}
+	stopPprofServer()
+	// notifications are bounded by their own timeout
+	pendingNotifications.Wait()
+	flushLogs()
+	closeOutputFiles()
+	if gcsLog != nil {
+		uploadGCSLog(gcsLogURI)
+	}
+
+	if exitCodeFile != "" {
+		// os.Exit truncates the code to its low byte, so record what callers will actually see
+		if err := ioutil.WriteFile(exitCodeFile, []byte(fmt.Sprintf("%d\n", code&0xff)), 0644); err != nil {
+			ErrorLogger.Printf("error writing exit code file: %v\n", err.Error())
+		}
+	}
+
+	os.Exit(code)
+}
+
+// openOutputFiles creates or truncates the --stdout-file and --stderr-file files, and
+// the file output is captured in for --gcs-log-uri.
+func openOutputFiles() error {
+
+	if stdoutFile != "" {
+		f, err := os.Create(stdoutFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("error opening --stdout-file: %v", err.Error()))
+		}
+		stdoutCopy = f
+	}
+
+	if stderrFile != "" && stderrFile == stdoutFile {
+		stderrCopy = stdoutCopy
+	} else if stderrFile != "" {
+		f, err := os.Create(stderrFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("error opening --stderr-file: %v", err.Error()))
+		}
+		stderrCopy = f
+	}
+
+	if gcsLogURI != "" {
+		return openGCSLog()
+	}
+
+	return nil
+}
+
+// closeOutputFiles syncs and closes the --stdout-file and --stderr-file files.
+func closeOutputFiles() {
+	files := []*os.File{stdoutCopy}
+	if stderrCopy != stdoutCopy {
+		files = append(files, stderrCopy)
+	}
+
+	for _, f := range files {
+		if f != nil {
+			_ = f.Sync()
+			_ = f.Close()
+		}
+	}
+}
+
+// openTeeFd returns the already-open file descriptor fd as a file, checking that it is writable.
+func openTeeFd(fd int) (*os.File, error) {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return nil, errors.New(fmt.Sprintf("--tee-fd %d is not an open file descriptor: %v", fd, errno.Error()))
+	}
+
+	if mode := flags & syscall.O_ACCMODE; mode != syscall.O_WRONLY && mode != syscall.O_RDWR {
+		return nil, errors.New(fmt.Sprintf("--tee-fd %d is not open for writing", fd))
+	}
+
+	return os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)), nil
+}
+
+// flagDefinition describes a command line flag for --dump-flags.
+type flagDefinition struct {
+	Name      string `json:"name"`
+	Shorthand string `json:"shorthand,omitempty"`
+	Type      string `json:"type"`
+	Default   string `json:"default"`
+	Usage     string `json:"usage"`
+	Hidden    bool   `json:"hidden,omitempty"`
+}
+
+// dumpFlags writes every defined flag to w as a JSON array, for external tooling.
+func dumpFlags(w io.Writer) error {
+	var flags []flagDefinition
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		flags = append(flags, flagDefinition{
+			Name:      f.Name,
+			Shorthand: f.Shorthand,
+			Type:      f.Value.Type(),
+			Default:   f.DefValue,
+			Usage:     f.Usage,
+			Hidden:    f.Hidden,
+		})
+	})
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(flags)
+}
+
+func parseArgs() (int, error) {
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags ...] [PROJECT_ID BUILD_ID] -- COMMAND [command-flags ...]\n", os.Args[0])
+		pflag.CommandLine.PrintDefaults()
+	}
+
+	pflag.StringVar(&projectId, "project-id", "", "ID of the project the build runs in; replaces the PROJECT_ID argument")
+	pflag.StringVar(&buildId, "build-id", "", "ID of the build; replaces the BUILD_ID argument")
+	pflag.StringVar(&stepName, "step-name", "", "name of the build step, included in log output; defaults to $BUILD_STEP")
+	pflag.StringVarP(&signalStr, "signal", "s", "SIGTERM", "signal to send to wrapped process; a comma-separated list, one per --before-timeout, sends each signal in turn; ex: SIGUSR1,SIGTERM")
+	pflag.StringVar(&timeoutSigStr, "timeout-signal", "", "signal to send to wrapped process when the build timeout approaches; defaults to --signal")
+	pflag.StringVar(&forwardMinIntervalStr, "forward-min-interval", "0s", "minimum time between signals forwarded to the process; signals arriving sooner are coalesced and the latest is forwarded once it has passed")
+	pflag.BoolVar(&preemptAware, "preempt-aware", false, "treat SIGTERM received by the wrapper as preemption of the worker and shut the process down as for the timeout, with --timeout-signal and --kill-after")
+	pflag.BoolVar(&upgradeFirstSignal, "upgrade-first-signal", false, "send --signal to the process in place of the first signal the wrapper receives")
+	pflag.StringVar(&killAfterStr, "kill-after", "0s", "if the process hasn't exited this long after the timeout signal, send --kill-signal; 0 waits indefinitely")
+	pflag.StringVar(&diagnosticSigStr, "diagnostic-signal", "", "before sending --kill-signal, send this signal so the process can dump diagnostics, e.g. SIGQUIT for a thread dump")
+	pflag.StringVar(&diagnosticGraceStr, "diagnostic-grace", "5s", "how long to wait after --diagnostic-signal before sending --kill-signal")
+	pflag.StringVar(&escalateIfSilentStr, "escalate-if-silent", "0s", "send --kill-signal if the process writes no output for this long after the timeout signal, even before --kill-after; 0 disables")
+	pflag.StringVar(&killSigStr, "kill-signal", "SIGKILL", "signal sent once --kill-after elapses")
+	pflag.StringVar(&notifyURL, "notify-url", "", "URL to POST a JSON notification to when the process is sent the timeout signal")
+	pflag.StringVar(&preSignalHook, "pre-signal-hook", "", "shell command to run just before the process is sent the timeout signal")
+	pflag.StringVar(&preSignalHookTimeoutStr, "pre-signal-hook-timeout", "10s", "maximum time to wait for --pre-signal-hook before signaling the process anyway")
+	pflag.StringVar(&restartSigStr, "restart-on-signal", "", "when the wrapper receives this signal, stop the process with --signal and start it again instead of forwarding it")
+	pflag.StringVar(&restartCutoffStr, "restart-cutoff", "0s", "don't restart the process for --restart-on-signal once the timeout signal is due within this long; it is sent the timeout signal instead")
+	pflag.BoolVar(&refreshOnRestart, "refresh-on-restart", false, "fetch the build again each time --restart-on-signal restarts the process, rather than keeping the signal time from startup")
+	pflag.StringVar(&fallbackSigStr, "fallback-signal", "", "signal to send if the timeout signal can't be delivered after a retry")
+	pflag.StringVar(&signalOnFile, "signal-on-file", "", "send --signal to the process when this file is created")
+	pflag.StringVar(&signalOnFileExisting, "signal-on-file-existing", "ignore", "what to do if the --signal-on-file file already exists at startup; one of: ignore, immediate")
+	pflag.StringVarP(&timeoutStr, "before-timeout", "t", "60s", "time before build timeout to send designated signal, or a percentage of the build timeout; a comma-separated list of either, one per --signal, sends each signal in turn; ex: 30s, 5m, 10%, 2m,30s, 20%,10%")
+	pflag.Float64Var(&remainingPercent, "signal-at-remaining-percent", 0, "instead of --before-timeout, signal when this percentage of the time remaining at startup is left; ex: 10")
+	pflag.BoolVar(&autoSafetyMargin, "auto-safety-margin", false, "signal earlier by a margin proportional to how long the Cloud Build API took to respond")
+	pflag.StringVar(&minLeadStr, "min-lead", "0s", "minimum time before build timeout to send the signal; shorter --before-timeout values are raised to it")
+	pflag.StringVar(&maxLeadStr, "max-lead", "0s", "maximum time before build timeout to send the signal, if non-zero; longer --before-timeout values are lowered to it")
+	pflag.StringVar(&jitterStr, "signal-time-jitter", "0s", "randomly move the signal time up to this much earlier to spread out parallel steps; ex: 10s")
+	pflag.StringVar(&aliasFile, "alias-file", "", "JSON file of named flag presets for use with --alias")
+	pflag.StringVar(&aliasName, "alias", "", "apply the named flag preset from --alias-file; flags on the command line take precedence")
+	pflag.BoolVar(&allowTightTiming, "allow-tight-timing", false, "warn instead of failing when the configured grace periods don't fit within the build timeout")
+	pflag.StringVar(&buildInfoFile, "build-info-file", "", "read the build from this JSON file, with at least startTime and timeout, instead of calling the Cloud Build API; ex: output of gcloud builds describe --format=json")
+	pflag.StringVar(&buildInfoCacheFile, "build-info-cache-file", "", "file in which to cache build info for later steps of the same build, avoiding repeated API calls")
+	pflag.StringVar(&buildInfoCacheTTLStr, "build-info-cache-ttl", "1h", "maximum age of a --build-info-cache-file before the API is called again")
+	pflag.StringVar(&region, "region", "", "region of the build, for builds run in regional worker pools; unset or \"global\" for global builds")
+	pflag.StringVar(&fallbackTimeoutStr, "fallback-timeout", "0s", "if the build can't be retrieved from the API, assume it times out this long from now instead of failing; ex: 10m")
+	pflag.StringVar(&timeoutCombinePolicy, "timeout-combine-policy", "api-preferred", "how to choose between the build's timeout and --fallback-timeout; one of: api-preferred (the fallback is only used if the build can't be retrieved), fixed-preferred (the build isn't retrieved), min (whichever signals earlier), max (whichever signals later)")
+	pflag.BoolVar(&checkConnectivityFlag, "check-connectivity", false, "before calling the Cloud Build API, check its endpoint can be resolved and connected to, to tell network problems apart from others")
+	pflag.StringVar(&apiTimeoutStr, "api-timeout", "30s", "maximum time to spend calling the Cloud Build API, including retries; 0 waits indefinitely")
+	pflag.StringVar(&credentialsFile, "credentials-file", "", "service account key file to call the Cloud Build API with, e.g. when running outside Cloud Build; not needed inside it, where the build's own credentials are used")
+	pflag.StringVar(&apiEndpoint, "api-endpoint", "", "host:port of the Cloud Build API to use instead of the default or regional endpoint, e.g. an emulator")
+	pflag.BoolVar(&apiInsecure, "api-insecure", false, "connect to --api-endpoint without TLS or credentials; for local emulators only")
+	pflag.IntVar(&apiRetries, "api-retries", 3, "number of times to retry the Cloud Build API call after transient errors")
+	pflag.StringVar(&waitForCredsStr, "wait-for-credentials", "0s", "wait up to this long for credentials to become available before calling the Cloud Build API")
+	pflag.StringVar(&deadlineSubstitution, "deadline-from-substitution", "", "build substitution holding a deadline to use instead of the build timeout, if set; an RFC 3339 time or a duration from --deadline-base; ex: _DEADLINE")
+	pflag.StringVar(&deadlineBase, "deadline-base", "start", "build timestamp the build timeout is measured from; one of: start, create")
+	pflag.StringVar(&exitCodeFile, "exit-code-file", "", "write the wrapper's exit code to this file before exiting")
+	pflag.BoolVar(&parallelChildren, "parallel-children", false, "run each of the commands separated by ::: as a child at the same time, under the one deadline, sending signals to all of them")
+	pflag.StringVar(&parallelExitPolicy, "parallel-exit-policy", "all-succeed", "with --parallel-children, how the children's exit codes combine; one of: all-succeed (wait for every child, and exit with the first failure), any-fail (on the first failure, send --timeout-signal to the rest and exit with it)")
+	pflag.BoolVar(&useShell, "shell", false, "run the command arguments, joined with spaces, as a script with --shell-path -c, so pipes and && work")
+	pflag.StringVar(&shellPath, "shell-path", "/bin/sh", "shell used by --shell")
+	pflag.StringArrayVar(&envOverrides, "env", nil, "set an environment variable for the process, as KEY=VALUE; may be repeated")
+	pflag.StringVar(&workdir, "workdir", "", "directory to run the process in; defaults to the wrapper's working directory")
+	pflag.StringVar(&workdirFromEnv, "workdir-from-env", "", "run the process in the directory named by this environment variable; ex: STEP_DIR")
+	pflag.BoolVar(&noStdin, "no-stdin", false, "don't pass the wrapper's stdin on to the process; it reads from /dev/null instead")
+	pflag.BoolVar(&holdStdinOpen, "hold-stdin-open", false, "give the process a stdin that stays open and never receives data, so it never sees EOF")
+	pflag.BoolVar(&timestampOutput, "timestamp-output", false, "prefix each line of the process's stdout and stderr with the time it was written")
+	pflag.StringVar(&timestampFormat, "timestamp-format", "2006-01-02T15:04:05.000Z07:00", "Go time layout used by --timestamp-output")
+	pflag.IntVar(&maxLineLength, "max-line-length", 0, "truncate lines of process output longer than this many bytes on the console; --tee-fd still gets them in full")
+	pflag.StringVar(&stdoutFile, "stdout-file", "", "also write the process's stdout to this file")
+	pflag.StringVar(&stderrFile, "stderr-file", "", "also write the process's stderr to this file; may be the same as --stdout-file")
+	pflag.StringVar(&gcsLogURI, "gcs-log-uri", "", "on exit, upload the process's stdout and stderr to this Cloud Storage object; ex: gs://bucket/logs/step.log")
+	pflag.IntVar(&maxOutputRate, "max-output-rate", 0, "warn when the process writes more than this many bytes per second over --output-rate-window; 0 disables")
+	pflag.IntVar(&maxOutputLineRate, "max-output-line-rate", 0, "warn when the process writes more than this many lines per second over --output-rate-window; 0 disables")
+	pflag.StringVar(&outputRateWindowStr, "output-rate-window", "10s", "period over which the process's output rate is measured for --max-output-rate and --max-output-line-rate")
+	pflag.StringVar(&outputRateSigStr, "output-rate-signal", "", "also send this signal to the process, once, when its output rate is exceeded")
+	pflag.IntVar(&teeFd, "tee-fd", -1, "also write a copy of the process's stdout and stderr to this already-open file descriptor")
+	pflag.StringVar(&exportFile, "export-file", "", "write the build deadline and signal time as shell export statements to this file")
+	pflag.StringVar(&minRuntimeStr, "min-runtime", "0s", "let the process run at least this long before it is signaled, even if that is later than the computed signal time")
+	pflag.StringVar(&countdownIntervalStr, "countdown-interval", "0s", "log how long the build has been running and the time left until the process is signaled this often; ex: 30s")
+	pflag.StringVar(&warnBeforeStr, "warn-before", "0s", "log a single warning when this much time remains before the process is signaled; ex: 2m")
+	pflag.IntVar(&gracefulExitCode, "graceful-exit-code", -1, "exit code used if the process exits after the timeout signal without needing --kill-signal; -1 keeps the process exit code")
+	pflag.IntVarP(&timeoutExitCode, "timeout-exitcode", "e", 0, "non-zero exit code used if process is timed out; overrides process exit code")
+	pflag.StringVar(&pollIntervalStr, "poll-interval", "0s", "if non-zero, check the build's status this often and signal the process as soon as the build is cancelled or times out")
+	pflag.StringVar(&pollIntervalMaxStr, "poll-interval-max", "0s", "if set, poll less often while the build deadline is far off, every tenth of the time left but at most this long and at least --poll-interval")
+	pflag.BoolVar(&reconcileStatus, "reconcile-build-status", false, "after the process exits, warn if the build has already ended with an outcome that disagrees with the process's, e.g. it was cancelled while the process succeeded; a build still running, as it is while its own steps run, isn't checked")
+	pflag.BoolVar(&signalDryRun, "signal-dry-run", false, "log the signals that would be sent to the process instead of sending them")
+	pflag.BoolVar(&keepaliveOnHup, "keepalive-on-sighup", false, "ignore SIGHUP instead of forwarding it, keeping the process running when the terminal disconnects")
+	pflag.BoolVar(&noCleanupChildren, "no-cleanup-children", false, "don't SIGKILL whatever is left in the process's group on exit; with --process-group=false, don't start it in its own process group either")
+	pflag.BoolVar(&processGroup, "process-group", true, "send signals to the process's whole process group, reaching its children too, rather than only the process itself")
+	pflag.BoolVar(&newSession, "new-session", false, "start the process in a new session, detached from the controlling terminal; signals are sent to its process group")
+	pflag.BoolVarP(&quiet, "quiet", "q", false, "suppress all output except process stdout and stderr")
+	pflag.StringVar(&childExitGraceStr, "child-exit-grace", "0s", "once the process exits, wait at most this long for the rest of its output when it goes through the wrapper; 0 waits until the output is closed")
+	pflag.BoolVar(&logExitDetails, "log-child-exit-details", false, "log exit status, CPU time and max RSS of the process when it exits")
+	pflag.StringVar(&redactArgsStr, "redact-args", defaultRedactArgs, "regular expression matching command arguments to mask in logs; empty to disable")
+	pflag.IntVar(&shortIdLength, "short-id-length", 8, "number of characters of the build ID shown where it is shortened in logs")
+	pflag.StringVar(&logFormat, "log-format", "text", "format of the wrapper's own log output; one of: text, json")
+	pflag.BoolVar(&jsonProcessOutput, "json-process-output", false, "with --log-format=json, also write each line of the process's output as a JSON log entry, embedding lines that are JSON objects, so that all output is NDJSON")
+	pflag.BoolVar(&cloudLogging, "cloud-logging", false, "also write the wrapper's own log entries directly to Cloud Logging, labeled with the build ID, in case stdout isn't captured")
+	pflag.BoolVar(&logDedup, "log-dedup", false, "collapse consecutive identical log lines into one with a repeat count")
+	pflag.StringVar(&pprofAddr, "pprof-addr", "", "serve the wrapper's own pprof profiles on this address while it runs; ex: localhost:6060")
+	pflag.BoolVarP(&verbose, "verbose", "v", false, "enable additional logging")
+	pflag.BoolVar(&dryRun, "dry-run", false, "print the build timeout and when the process would be signaled, and exit without running it")
+	pflag.BoolVar(&validateOnly, "validate", false, "validate flags and arguments, report all problems found and exit without running anything")
+	pflag.StringVar(&buildInfoFile, "api-mock-file", "", "alias of --build-info-file")
+	_ = pflag.CommandLine.MarkHidden("api-mock-file")
+	pflag.StringVar(&dumpFlagsFormat, "dump-flags", "", "print all flag definitions in the given format and exit; only json is supported")
+	_ = pflag.CommandLine.MarkHidden("dump-flags")
+	help := pflag.BoolP("help", "h", false, "print this usage and exit")
+	showVersion := pflag.Bool("version", false, "print version information and exit")
+
+	pflag.Parse()
+
+	if *help {
+		return 0, &UserRequestedHelp{}
+	}
+
+	if *showVersion {
+		return 0, &UserRequestedVersion{}
+	}
+
+	if dumpFlagsFormat != "" {
+		if dumpFlagsFormat != "json" {
+			return 1, errors.New(fmt.Sprintf("--dump-flags only supports json, got %v", dumpFlagsFormat))
+		}
+		return 0, &UserRequestedFlagDump{}
+	}
+
+	var problems []string
+
+	if aliasName != "" {
+		if err := applyAlias(aliasFile, aliasName); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if name, err := canonicalSignalName(killSigStr); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		killSigStr = name
+	}
+
+	if killAfter, err := time.ParseDuration(killAfterStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --kill-after: %v", err.Error()))
+	} else if killAfter < 0 {
+		problems = append(problems, "--kill-after must not be negative")
+	} else {
+		killAfterDur = killAfter
+	}
+
+	if diagnosticSigStr != "" {
+		if name, err := canonicalSignalName(diagnosticSigStr); err != nil {
+			problems = append(problems, err.Error())
+		} else if uncatchableSignals[name] {
+			problems = append(problems, fmt.Sprintf("--diagnostic-signal can't be %v, which the process can't handle to dump diagnostics", name))
+		} else {
+			diagnosticSigStr = name
+		}
+	}
+
+	if grace, err := time.ParseDuration(diagnosticGraceStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --diagnostic-grace: %v", err.Error()))
+	} else if grace < 0 {
+		problems = append(problems, "--diagnostic-grace must not be negative")
+	} else {
+		diagnosticGraceDur = grace
+	}
+
+	if maxOutputRate < 0 || maxOutputLineRate < 0 {
+		problems = append(problems, "--max-output-rate and --max-output-line-rate must not be negative")
+	}
+
+	if window, err := time.ParseDuration(outputRateWindowStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --output-rate-window: %v", err.Error()))
+	} else if window <= 0 {
+		problems = append(problems, "--output-rate-window must be positive")
+	} else {
+		outputRateWindowDur = window
+	}
+
+	if outputRateSigStr != "" {
+		if name, err := canonicalSignalName(outputRateSigStr); err != nil {
+			problems = append(problems, err.Error())
+		} else if maxOutputRate == 0 && maxOutputLineRate == 0 {
+			problems = append(problems, "--output-rate-signal requires --max-output-rate or --max-output-line-rate")
+		} else {
+			outputRateSigStr = name
+		}
+	}
+
+	if silent, err := time.ParseDuration(escalateIfSilentStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --escalate-if-silent: %v", err.Error()))
+	} else if silent < 0 {
+		problems = append(problems, "--escalate-if-silent must not be negative")
+	} else {
+		escalateIfSilentDur = silent
+	}
+
+	if restartSigStr != "" {
+		if name, err := canonicalSignalName(restartSigStr); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			restartSigStr = name
+		}
+	} else if refreshOnRestart {
+		problems = append(problems, "--refresh-on-restart requires --restart-on-signal")
+	}
+
+	if cutoff, err := time.ParseDuration(restartCutoffStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --restart-cutoff: %v", err.Error()))
+	} else if cutoff < 0 {
+		problems = append(problems, "--restart-cutoff must not be negative")
+	} else {
+		restartCutoffDur = cutoff
+	}
+
+	if fallbackSigStr != "" {
+		if name, err := canonicalSignalName(fallbackSigStr); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			fallbackSigStr = name
+		}
+	}
+
+	if maxLineLength < 0 {
+		problems = append(problems, "--max-line-length must not be negative")
+	}
+
+	if teeFd >= 0 {
+		if f, err := openTeeFd(teeFd); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			teeFile = f
+		}
+	}
+
+	// the files are only opened, and truncated, once the process is about to run
+	if stdoutFile != "" {
+		if err := checkWritable(stdoutFile); err != nil {
+			problems = append(problems, fmt.Sprintf("--stdout-file: %v", err.Error()))
+		}
+	}
+
+	if stderrFile != "" && stderrFile != stdoutFile {
+		if err := checkWritable(stderrFile); err != nil {
+			problems = append(problems, fmt.Sprintf("--stderr-file: %v", err.Error()))
+		}
+	}
+
+	if gcsLogURI != "" {
+		if _, _, err := parseGCSURI(gcsLogURI); err != nil {
+			problems = append(problems, fmt.Sprintf("--gcs-log-uri: %v", err.Error()))
+		}
+	}
+
+	// the project and build IDs are positional unless supplied by flags, or, when only the
+	// command follows "--", taken from the environment Cloud Build provides if it's there
+	if pflag.CommandLine.ArgsLenAtDash() == 0 && (projectId == "" || buildId == "") {
+		envProjectId, envBuildId := os.Getenv("PROJECT_ID"), os.Getenv("BUILD_ID")
+		available := (projectId != "" || envProjectId != "") && (buildId != "" || envBuildId != "")
+
+		// "-- PROJECT_ID BUILD_ID COMMAND" is also accepted, and inside Cloud Build the IDs
+		// given that way are the same as the ones in the environment
+		args := pflag.Args()
+		positional := projectId == "" && buildId == "" && len(args) > 2 &&
+			args[0] == envProjectId && args[1] == envBuildId
+
+		if available && !positional {
+			if projectId == "" {
+				projectId = envProjectId
+			}
+			if buildId == "" {
+				buildId = envBuildId
+			}
+		}
+	}
+
+	requiredArgs := 1
+	if projectId == "" {
+		requiredArgs++
+	}
+	if buildId == "" {
+		requiredArgs++
+	}
+
+	if len(pflag.Args()) < requiredArgs {
+		problems = append(problems, fmt.Sprintf("%v requires at least %v positional arguments, got %v", os.Args[0], requiredArgs, len(pflag.Args())))
+	}
+
+	if signals, leads := strings.Split(signalStr, ","), strings.Split(timeoutStr, ","); len(signals) != len(leads) {
+		problems = append(problems, fmt.Sprintf("--signal and --before-timeout lists must be the same length; got %d and %d", len(signals), len(leads)))
+		signalStr, timeoutStr = signals[len(signals)-1], leads[len(leads)-1]
+	} else if len(signals) > 1 {
+		// leads of different kinds can't be ordered until the build timeout is known
+		mixed := strings.Count(timeoutStr, "%") > 0 && strings.Count(timeoutStr, "%") < len(leads)
+		if mixed {
+			problems = append(problems, "--before-timeout list must be all durations or all percentages")
+		}
+
+		previous := -1.0
+		for i := range signals {
+			lead, percent, err := parseLead(leads[i])
+			if err != nil {
+				// the last value is checked along with a single --before-timeout below
+				if i < len(signals)-1 {
+					problems = append(problems, fmt.Sprintf("error with supplied value to --before-timeout: %v", err.Error()))
+				}
+				continue
+			}
+			if value := float64(lead) + percent; !mixed && previous >= 0 && value >= previous {
+				problems = append(problems, fmt.Sprintf("--before-timeout list must be strictly decreasing; %v follows %v", leads[i], leads[i-1]))
+			}
+			previous = float64(lead) + percent
+
+			if i == len(signals)-1 {
+				break
+			}
+			if name, err := canonicalSignalName(signals[i]); err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				escalationStages = append(escalationStages, escalationStage{signal: name, lead: lead, percent: percent})
+			}
+		}
+
+		// the last signal in the list is the one sent for the timeout
+		signalStr, timeoutStr = signals[len(signals)-1], leads[len(leads)-1]
+	}
+
+	if name, err := canonicalSignalName(signalStr); err != nil {
+		problems = append(problems, err.Error())
+	} else if uncatchableSignals[name] {
+		problems = append(problems, fmt.Sprintf("--signal can't be %v, which the process can't handle to shut down gracefully; use --kill-after and --kill-signal to force it to stop", name))
+	} else {
+		signalStr = name
+		warnIfIgnoredByDefault("--signal", signalStr)
+	}
+
+	if timeoutSigStr == "" {
+		timeoutSigStr = signalStr
+	} else if name, err := canonicalSignalName(timeoutSigStr); err != nil {
+		problems = append(problems, err.Error())
+	} else if uncatchableSignals[name] {
+		problems = append(problems, fmt.Sprintf("--timeout-signal can't be %v, which the process can't handle to shut down gracefully; use --kill-after and --kill-signal to force it to stop", name))
+	} else {
+		timeoutSigStr = name
+		warnIfIgnoredByDefault("--timeout-signal", timeoutSigStr)
+	}
+
+	if dur, percent, err := parseLead(timeoutStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --before-timeout: %v", err.Error()))
+	} else {
+		timeoutDur, timeoutPercent = dur, percent
+	}
+
+	if jitter, err := time.ParseDuration(jitterStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --signal-time-jitter: %v", err.Error()))
+	} else if jitter < 0 {
+		problems = append(problems, "--signal-time-jitter must not be negative")
+	} else {
+		jitterDur = jitter
+	}
+
+	if minLead, err := time.ParseDuration(minLeadStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --min-lead: %v", err.Error()))
+	} else {
+		minLeadDur = minLead
+	}
+
+	if maxLead, err := time.ParseDuration(maxLeadStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --max-lead: %v", err.Error()))
+	} else {
+		maxLeadDur = maxLead
+	}
+
+	if maxLeadDur > 0 && minLeadDur > maxLeadDur {
+		problems = append(problems, fmt.Sprintf("--min-lead (%v) must not be greater than --max-lead (%v)", minLeadDur, maxLeadDur))
+	}
+
+	if warnBefore, err := time.ParseDuration(warnBeforeStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --warn-before: %v", err.Error()))
+	} else if warnBefore < 0 {
+		problems = append(problems, "--warn-before must not be negative")
+	} else {
+		warnBeforeDur = warnBefore
+	}
+
+	if fallback, err := time.ParseDuration(fallbackTimeoutStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --fallback-timeout: %v", err.Error()))
+	} else if fallback < 0 {
+		problems = append(problems, "--fallback-timeout must not be negative")
+	} else {
+		fallbackTimeoutDur = fallback
+	}
+
+	switch timeoutCombinePolicy {
+	case "api-preferred", "fixed-preferred", "min", "max":
+		if timeoutCombinePolicy != "api-preferred" && fallbackTimeoutDur == 0 {
+			problems = append(problems, fmt.Sprintf("--timeout-combine-policy=%v requires --fallback-timeout", timeoutCombinePolicy))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("--timeout-combine-policy must be one of api-preferred, fixed-preferred, min, max; got %v", timeoutCombinePolicy))
+	}
+
+	if gracefulExitCode < -1 || gracefulExitCode > 255 {
+		problems = append(problems, "--graceful-exit-code must be between 0 and 255, or -1")
+	}
+
+	if dur, err := time.ParseDuration(apiTimeoutStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --api-timeout: %v", err.Error()))
+	} else if dur < 0 {
+		problems = append(problems, "--api-timeout must not be negative")
+	} else {
+		apiTimeoutDur = dur
+	}
+
+	if dur, err := time.ParseDuration(minRuntimeStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --min-runtime: %v", err.Error()))
+	} else if dur < 0 {
+		problems = append(problems, "--min-runtime must not be negative")
+	} else {
+		minRuntimeDur = dur
+	}
+
+	if dur, err := time.ParseDuration(countdownIntervalStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --countdown-interval: %v", err.Error()))
+	} else if dur < 0 {
+		problems = append(problems, "--countdown-interval must not be negative")
+	} else {
+		countdownIntervalDur = dur
+	}
+
+	if dur, err := time.ParseDuration(childExitGraceStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --child-exit-grace: %v", err.Error()))
+	} else if dur < 0 {
+		problems = append(problems, "--child-exit-grace must not be negative")
+	} else {
+		childExitGraceDur = dur
+	}
+
+	if dur, err := time.ParseDuration(pollIntervalStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --poll-interval: %v", err.Error()))
+	} else if dur < 0 {
+		problems = append(problems, "--poll-interval must not be negative")
+	} else {
+		pollIntervalDur = dur
+	}
+
+	if dur, err := time.ParseDuration(pollIntervalMaxStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --poll-interval-max: %v", err.Error()))
+	} else if dur != 0 && pollIntervalDur == 0 {
+		problems = append(problems, "--poll-interval-max requires --poll-interval")
+	} else if dur != 0 && dur < pollIntervalDur {
+		problems = append(problems, fmt.Sprintf("--poll-interval-max (%v) must not be less than --poll-interval (%v)", dur, pollIntervalDur))
+	} else {
+		pollIntervalMaxDur = dur
+	}
+
+	if dur, err := time.ParseDuration(forwardMinIntervalStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --forward-min-interval: %v", err.Error()))
+	} else if dur < 0 {
+		problems = append(problems, "--forward-min-interval must not be negative")
+	} else {
+		forwardMinIntervalDur = dur
+	}
+
+	if notifyURL != "" {
+		if u, err := url.Parse(notifyURL); err != nil {
+			problems = append(problems, fmt.Sprintf("error with supplied value to --notify-url: %v", err.Error()))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			problems = append(problems, fmt.Sprintf("--notify-url must be an http or https URL; got %v", notifyURL))
+		}
+	}
+
+	if dur, err := time.ParseDuration(preSignalHookTimeoutStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --pre-signal-hook-timeout: %v", err.Error()))
+	} else if dur <= 0 {
+		problems = append(problems, "--pre-signal-hook-timeout must be positive")
+	} else {
+		preSignalHookTimeoutDur = dur
+	}
+
+	if apiInsecure && apiEndpoint == "" {
+		problems = append(problems, "--api-insecure requires --api-endpoint")
+	}
+
+	if credentialsFile != "" {
+		if _, err := os.Stat(credentialsFile); err != nil {
+			problems = append(problems, fmt.Sprintf("--credentials-file: %v", err.Error()))
+		} else if apiInsecure {
+			problems = append(problems, "--credentials-file can't be used with --api-insecure")
+		}
+	}
+
+	if apiRetries < 0 {
+		problems = append(problems, "--api-retries must not be negative")
+	}
+
+	if wait, err := time.ParseDuration(waitForCredsStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --wait-for-credentials: %v", err.Error()))
+	} else {
+		waitForCredsDur = wait
+	}
+
+	if ttl, err := time.ParseDuration(buildInfoCacheTTLStr); err != nil {
+		problems = append(problems, fmt.Sprintf("error with supplied value to --build-info-cache-ttl: %v", err.Error()))
+	} else {
+		buildInfoCacheTTLDur = ttl
+	}
+
+	if remainingPercent < 0 || remainingPercent >= 100 {
+		problems = append(problems, fmt.Sprintf("--signal-at-remaining-percent must be between 0 and 100, got %v", remainingPercent))
+	} else if remainingPercent > 0 && pflag.CommandLine.Lookup("before-timeout").Changed {
+		problems = append(problems, "--signal-at-remaining-percent can't be used with --before-timeout, which it replaces")
+	}
+
+	if shortIdLength < 1 {
+		problems = append(problems, "--short-id-length must be at least 1")
+	}
+
+	if noStdin && holdStdinOpen {
+		problems = append(problems, "--no-stdin can't be used with --hold-stdin-open")
+	}
+
+	for _, env := range envOverrides {
+		if strings.Index(env, "=") < 1 {
+			problems = append(problems, fmt.Sprintf("--env must be given as KEY=VALUE; got %q", env))
+		}
+	}
+
+	if workdir != "" && workdirFromEnv != "" {
+		problems = append(problems, "--workdir can't be used with --workdir-from-env")
+	} else if workdir != "" {
+		if err := checkDirectory(workdir); err != nil {
+			problems = append(problems, fmt.Sprintf("--workdir: %v", err.Error()))
+		} else {
+			commandDir = workdir
+		}
+	} else if workdirFromEnv != "" {
+		dir := os.Getenv(workdirFromEnv)
+		if dir == "" {
+			problems = append(problems, fmt.Sprintf("--workdir-from-env: environment variable %v is not set", workdirFromEnv))
+		} else if err := checkDirectory(dir); err != nil {
+			problems = append(problems, fmt.Sprintf("--workdir-from-env: %v", err.Error()))
+		} else {
+			commandDir = dir
+		}
+	}
+
+	if logFormat != "text" && logFormat != "json" {
+		problems = append(problems, fmt.Sprintf("--log-format must be one of text, json; got %v", logFormat))
+	} else if logFormat == "json" && logDedup {
+		problems = append(problems, "--log-dedup can't be used with --log-format=json")
+	}
+
+	if jsonProcessOutput && logFormat != "json" {
+		problems = append(problems, "--json-process-output requires --log-format=json")
+	} else if jsonProcessOutput && timestampOutput {
+		problems = append(problems, "--timestamp-output can't be used with --json-process-output, whose entries are already timestamped")
+	}
+
+	if signalOnFileExisting != "ignore" && signalOnFileExisting != "immediate" {
+		problems = append(problems, fmt.Sprintf("--signal-on-file-existing must be one of ignore, immediate; got %v", signalOnFileExisting))
+	}
+
+	if pflag.Lookup("step-name").Changed {
+		if strings.TrimSpace(stepName) == "" {
+			problems = append(problems, "--step-name must not be empty")
+		}
+	} else {
+		stepName = os.Getenv("BUILD_STEP")
+	}
+
+	if redactArgsStr != "" {
+		if pattern, err := regexp.Compile(redactArgsStr); err != nil {
+			problems = append(problems, fmt.Sprintf("error with supplied value to --redact-args: %v", err.Error()))
+		} else {
+			redactPattern = pattern
+		}
+	}
+
+	if region == "global" {
+		region = ""
+	}
+
+	if deadlineBase != "start" && deadlineBase != "create" {
+		problems = append(problems, fmt.Sprintf("--deadline-base must be one of start, create; got %v", deadlineBase))
+	}
+
+	if parallelExitPolicy != "all-succeed" && parallelExitPolicy != "any-fail" {
+		problems = append(problems, fmt.Sprintf("--parallel-exit-policy must be one of all-succeed, any-fail; got %v", parallelExitPolicy))
+	}
+
+	if len(problems) > 0 {
+		return 1, &InvalidArgs{Problems: problems}
+	}
+
+	args := pflag.Args()
+	if projectId == "" {
+		projectId, args = args[0], args[1:]
+	}
+	if buildId == "" {
+		buildId, args = args[0], args[1:]
+	}
+	cmdName = args[0]
+	cmdArgs = args[1:]
+
+	if parallelChildren {
+		// each command is run with the shell separately by newParallelRunner
+		if _, err := splitCommandGroups(args); err != nil {
+			return 1, &InvalidArgs{Problems: []string{err.Error()}}
+		}
+	} else if useShell {
+		// the whole pipeline runs in the shell's process group, so --process-group signals
+		// reach every command in it
+		cmdName, cmdArgs = shellPath, []string{"-c", strings.Join(args, " ")}
+	}
+
+	return 0, nil
+}
+
+func main() {
+	InfoLogger = log.New(os.Stdout, "INFO: ", log.LstdFlags)
+	WarningLogger = log.New(os.Stdout, "WARNING: ", log.LstdFlags)
+	ErrorLogger = log.New(os.Stderr, "ERROR: ", log.LstdFlags)
+
+	if exitCode, err := parseArgs(); err != nil {
+		if _, ok := err.(*UserRequestedVersion); ok {
+			fmt.Printf("gcbcw %v (commit %v, built %v)\n", version, commit, buildDate)
+			exit(0)
+		}
+
+		if _, ok := err.(*UserRequestedFlagDump); ok {
+			if err := dumpFlags(os.Stdout); err != nil {
+				ErrorLogger.Println(err.Error())
+				exit(1)
+			}
+			exit(0)
+		}
+
+		if !validateOnly {
+			pflag.Usage()
+		}
+
+		if _, ok := err.(*UserRequestedHelp); !ok {
+			_, _ = fmt.Fprintf(os.Stderr, "%v\n", err.Error())
+		}
+
+		exit(exitCode)
+	}
+
+	if parallelChildren {
+		newCommandRunner = newParallelRunner
+	}
+
+	if stepName != "" {
+		InfoLogger.SetPrefix(fmt.Sprintf("INFO: [%s] ", stepName))
+		WarningLogger.SetPrefix(fmt.Sprintf("WARNING: [%s] ", stepName))
+		ErrorLogger.SetPrefix(fmt.Sprintf("ERROR: [%s] ", stepName))
+	}
+
+	if logFormat == "json" {
+		enableJSONLogs()
+	}
+
+	if logDedup {
+		enableLogDedup()
+	}
+
+	if validateOnly {
+		fmt.Println("Configuration is valid")
+		exit(0)
+	}
+
+	if pprofAddr != "" {
+		if err := startPprofServer(pprofAddr); err != nil {
+			ErrorLogger.Println(err.Error())
+			exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelMain = cancel
+	if cloudLogging {
+		if err := enableCloudLogging(ctx); err != nil && !quiet {
+			// the wrapper's logs still reach stdout and stderr
+			WarningLogger.Println(err.Error())
+		}
+	}
+	signalTime, err := getSignalTime(ctx, time.Now())
+	if err != nil {
+		ErrorLogger.Println(err.Error())
+		exit(1)
+	}
+
+	if dryRun {
+		printSchedule(time.Now(), signalTime)
+		exit(0)
+	}
+
+	adjustedTimeout := noSignalTimeout
+	if signalTime != nil {
+		delayed := minRuntimeSignalTime(*signalTime, time.Now())
+		signalTime = &delayed
+		logSignalTime = *signalTime
+
+		if exportFile != "" {
+			if err := writeExportFile(exportFile, buildDeadline, *signalTime); err != nil {
+				ErrorLogger.Println(err.Error())
+				exit(1)
+			}
+		}
+		adjustedTimeout = signalTime.Sub(time.Now())
+
+		if !quiet {
+			logScheduleSummary(time.Now(), *signalTime)
+		}
+	}
+
+	caughtSigsChan := make(chan os.Signal, 1)
+	signal.Notify(caughtSigsChan)
+	// catch everything but SIGCHLD
+	// because we will have a child process this doesn't make sense to catch
+	signal.Reset(syscall.SIGCHLD)
+	// the Go runtime sends itself SIGURG to preempt goroutines, so it isn't meant for the child
+	signal.Reset(syscall.SIGURG)
+	if keepaliveOnHup {
+		// like nohup, swallow SIGHUP rather than forwarding it so the process keeps running
+		signal.Ignore(syscall.SIGHUP)
+	}
+
+	if err := openOutputFiles(); err != nil {
+		ErrorLogger.Println(err.Error())
+		exit(1)
+	}
+
+	err = runCommand(ctx, cmdName, cmdArgs, adjustedTimeout, caughtSigsChan)
+
+	if reconcileStatus {
+		reconcileBuildStatus(ctx, err == nil)
+	}
+
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			exitCode := exitError.ExitCode()
+
+			if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				// ExitCode is -1 for a process killed by a signal; exit the way a shell would
+				exitCode = 128 + int(status.Signal())
+
+				if !quiet {
+					WarningLogger.Printf("Process was terminated by %v; exiting with code %d\n", signalName(status.Signal()), exitCode)
+				}
+			} else if !quiet {
+				WarningLogger.Printf("Process exited with non-zero exit code: %d\n", exitCode)
+			}
+
+			if code, ok := timedOutExitCode(); ok {
+				exit(code)
+			}
+
+			exit(exitCode)
+		} else if exitCode, ok := startErrorExitCode(err); ok {
+			if !quiet {
+				ErrorLogger.Printf("Unable to start process: %v\n", err.Error())
+			}
+
+			exit(exitCode)
+		} else {
+			if !quiet {
+				ErrorLogger.Println(err.Error())
+			}
+
+			if code, ok := timedOutExitCode(); ok {
+				exit(code)
+			}
+
+			exit(1)
+		}
+	} else {
+		if verbose {
+			InfoLogger.Println("Process exited successfully")
+		}
+
+		if code, ok := timedOutExitCode(); ok {
+			exit(code)
+		}
+	}
+
+	exit(0)
 }
@@ -0,0 +1,47 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWarnIfIgnoredByDefault(t *testing.T) {
+	savedQuiet := quiet
+	defer func() { quiet = savedQuiet }()
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"SIGWINCH", true},
+		{"SIGCHLD", true},
+		{"SIGIO", true},
+		{"SIGTERM", false},
+		{"SIGUSR1", false},
+	}
+	for _, tt := range tests {
+		warnings := captureWarnings(t)
+		warnIfIgnoredByDefault("--signal", tt.name)
+		if got := strings.Contains(warnings.String(), "is ignored by default on "+runtime.GOOS); got != tt.want {
+			t.Errorf("%v: warned = %v, want %v; warnings %q", tt.name, got, tt.want, warnings.String())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// processGone reports whether pid has exited, treating zombies as exited.
+func processGone(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// the state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestSurvivingChildrenKilledAtExit(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "-q", "--no-stdin", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", "sleep 30 >/dev/null 2>&1 & echo $!")
+	if code != 0 {
+		t.Fatalf("exit code = %d, want 0; output: %s", code, out)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("unexpected output %q", out)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !processGone(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("background process %d survived the wrapper", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSurvivingChildrenKeptWithNoCleanup(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "-q", "--no-stdin", "--no-cleanup-children", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", "sleep 30 >/dev/null 2>&1 & echo $!")
+	if code != 0 {
+		t.Fatalf("exit code = %d, want 0; output: %s", code, out)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("unexpected output %q", out)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	time.Sleep(200 * time.Millisecond)
+	if processGone(pid) {
+		t.Errorf("background process %d was killed despite --no-cleanup-children", pid)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals available: %v", err)
+	}
+	defer ptmx.Close()
+	var unlock, n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatal(errno)
+	}
+	pts, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("can't open pseudo-terminal: %v", err)
+	}
+	defer pts.Close()
+	if !isTerminal(pts.Fd()) {
+		t.Error("isTerminal = false for a pseudo-terminal")
+	}
+
+	file, err := ioutil.TempFile(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if isTerminal(file.Fd()) {
+		t.Error("isTerminal = true for a regular file")
+	}
+}
+
+func TestSignalDryRunLeavesChildrenRunning(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "--signal-dry-run", "--no-stdin", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", "sleep 30 >/dev/null 2>&1 & echo $!")
+	if code != 0 {
+		t.Fatalf("exit code = %d, want 0; output: %s", code, out)
+	}
+	if !strings.Contains(out, "would send SIGKILL") {
+		t.Errorf("output %q doesn't report the kill it would have sent", out)
+	}
+	var pid int
+	for _, line := range strings.Split(out, "\n") {
+		if n, err := strconv.Atoi(strings.TrimSpace(line)); err == nil {
+			pid = n
+		}
+	}
+	if pid == 0 {
+		t.Fatalf("no PID in output %q", out)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	time.Sleep(200 * time.Millisecond)
+	if processGone(pid) {
+		t.Errorf("background process %d was killed despite --signal-dry-run", pid)
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	// fields 5 and 6 of /proc/PID/stat are the process group and session IDs
+	out, code := runWrapper(t, "-q", "--new-session", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `echo $$ $(cut -d" " -f5,6 /proc/$$/stat)`)
+	if code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, out)
+	}
+	ids := strings.Fields(out)
+	if len(ids) != 3 || ids[1] != ids[0] || ids[2] != ids[0] {
+		t.Errorf("pid, process group and session = %q; want the process to lead its own session", out)
+	}
+}
+
+func TestExecRunnerPidfd(t *testing.T) {
+	savedNoStdin, savedGroup := noStdin, processGroup
+	defer func() { noStdin, processGroup = savedNoStdin, savedGroup }()
+	noStdin, processGroup = true, false
+
+	runner, err := newExecRunner(context.Background(), "sleep", []string{"5"}, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := runner.(*execRunner)
+	if r.pidfd < 0 {
+		r.Signal(syscall.SIGKILL)
+		r.Wait()
+		t.Skip("pidfd_open isn't supported by this kernel")
+	}
+
+	if err := r.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("signaling through the pidfd returned %v", err)
+	}
+	err = r.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+		t.Errorf("Wait returned %v, want the process terminated by SIGTERM", err)
+	}
+	if r.pidfd != -1 {
+		t.Errorf("pidfd %d is still open after the process was reaped", r.pidfd)
+	}
+	if err := r.Signal(syscall.SIGTERM); !isProcessDone(err) {
+		t.Errorf("signaling the reaped process returned %v, want it reported as done", err)
+	}
+}
+
+func TestPidfdSignalAfterReaped(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := openPidfd(cmd.Process.Pid)
+	if err != nil {
+		cmd.Wait()
+		t.Skipf("pidfd_open isn't supported by this kernel: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the PID may be reused from here on, but the pidfd still refers to the reaped process
+	if err := pidfdSignal(fd, syscall.SIGTERM); err != syscall.ESRCH {
+		t.Errorf("signaling a reaped process through its pidfd returned %v, want ESRCH", err)
+	}
+}
+
+func TestWarnIfIgnoredByDefault(t *testing.T) {
+	savedQuiet := quiet
+	defer func() { quiet = savedQuiet }()
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"SIGWINCH", true},
+		{"SIGCHLD", true},
+		{"SIGURG", true},
+		// terminates the process on Linux, unlike on the BSDs
+		{"SIGIO", false},
+		{"SIGTERM", false},
+		{"SIGUSR1", false},
+	}
+	for _, tt := range tests {
+		warnings := captureWarnings(t)
+		warnIfIgnoredByDefault("--signal", tt.name)
+		if got := strings.Contains(warnings.String(), "is ignored by default on linux"); got != tt.want {
+			t.Errorf("%v: warned = %v, want %v; warnings %q", tt.name, got, tt.want, warnings.String())
+		}
+	}
+}
@@ -0,0 +1,1504 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cloudbuildpb "google.golang.org/genproto/googleapis/devtools/cloudbuild/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs the wrapper itself instead of the tests when the test binary is re-executed
+// by runWrapper, so process-level behavior can be tested without a separate build.
+func TestMain(m *testing.M) {
+	if os.Getenv("GCBCW_TEST_MAIN") == "1" {
+		os.Args = append([]string{"gcbcw"}, os.Args[1:]...)
+		main()
+		return
+	}
+	InfoLogger = log.New(ioutil.Discard, "", 0)
+	WarningLogger = log.New(ioutil.Discard, "", 0)
+	ErrorLogger = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// runWrapper runs the wrapper with args and returns its combined output and exit code.
+func runWrapper(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	return runWrapperWithEnv(t, nil, args...)
+}
+
+// runWrapperWithEnv is runWrapper with env added to the wrapper's environment.
+func runWrapperWithEnv(t *testing.T, env []string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), env...), "GCBCW_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running wrapper: %v", err)
+	}
+	return string(out), 0
+}
+
+// writeBuildInfo writes a --build-info-file for a build that started ago and times out after timeout.
+func writeBuildInfo(t *testing.T, ago, timeout time.Duration) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "build.json")
+	start := time.Now().Add(-ago).UTC().Format(time.RFC3339Nano)
+	content := fmt.Sprintf(`{"id":"abcdef123456","startTime":%q,"timeout":"%.3fs","status":"WORKING"}`, start, timeout.Seconds())
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWrapperExitsWithProcessExitCode(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "-q", "--build-info-file", path, "proj", "abcdef123456", "--", "sh", "-c", "echo hello; exit 3")
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if !strings.Contains(out, "hello") {
+		t.Errorf("output %q doesn't contain the process output", out)
+	}
+}
+
+func TestReadBuildFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"complete", `{"id":"abc","startTime":"2020-01-01T00:00:00Z","timeout":"600s"}`, ""},
+		{"unknown fields ignored", `{"id":"abc","startTime":"2020-01-01T00:00:00Z","timeout":"600s","extra":1}`, ""},
+		{"missing startTime", `{"id":"abc","timeout":"600s"}`, "no startTime"},
+		{"misspelled timeout", `{"id":"abc","startTime":"2020-01-01T00:00:00Z","timout":"600s"}`, "no timeout"},
+		{"invalid JSON", `{"id":`, "error parsing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "build.json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readBuildFile(path)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildInfoFileMissingTimeoutFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.json")
+	if err := ioutil.WriteFile(path, []byte(`{"id":"abcdef123456","startTime":"2020-01-01T00:00:00Z"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runWrapper(t, "--api-mock-file", path, "proj", "abcdef123456", "--", "true")
+	if code == 0 || !strings.Contains(out, "no timeout") {
+		t.Errorf("exit code = %d, output %q; want a failure reporting the missing timeout", code, out)
+	}
+}
+
+func TestMinRuntimeSignalTime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	savedDeadline, savedMinRuntime, savedKillAfter := buildDeadline, minRuntimeDur, killAfterDur
+	defer func() { buildDeadline, minRuntimeDur, killAfterDur = savedDeadline, savedMinRuntime, savedKillAfter }()
+	tests := []struct {
+		name       string
+		deadline   time.Duration
+		signal     time.Duration
+		minRuntime time.Duration
+		killAfter  time.Duration
+		want       time.Duration
+	}{
+		{"disabled", 10 * time.Minute, time.Minute, 0, 0, time.Minute},
+		{"signal already late enough", 10 * time.Minute, 9 * time.Minute, 5 * time.Minute, 0, 9 * time.Minute},
+		{"delayed", 10 * time.Minute, time.Minute, 5 * time.Minute, 0, 5 * time.Minute},
+		{"capped at deadline", 10 * time.Minute, 9 * time.Minute, 20 * time.Minute, 0, 10 * time.Minute},
+		{"capped at deadline less kill-after", 10 * time.Minute, time.Minute, 20 * time.Minute, 2 * time.Minute, 8 * time.Minute},
+		{"no window after signal time", 10 * time.Minute, 9 * time.Minute, 20 * time.Minute, 2 * time.Minute, 9 * time.Minute},
+		{"deadline already passed", -time.Minute, -2 * time.Minute, 5 * time.Minute, 0, -time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buildDeadline = now.Add(tt.deadline)
+			minRuntimeDur = tt.minRuntime
+			killAfterDur = tt.killAfter
+			if got := minRuntimeSignalTime(now.Add(tt.signal), now); !got.Equal(now.Add(tt.want)) {
+				t.Errorf("signal time = %v, want %v", got.Sub(now), tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputFilesUntouchedWithoutRunning(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	out := filepath.Join(t.TempDir(), "out.txt")
+	if err := ioutil.WriteFile(out, []byte("previous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []string{"--validate", "--dry-run"} {
+		if output, code := runWrapper(t, "-q", flag, "--stdout-file", out, "--build-info-file", build, "proj", "abcdef123456", "--", "echo", "new"); code != 0 {
+			t.Fatalf("%v: exit code = %d; output: %s", flag, code, output)
+		}
+		if data, _ := ioutil.ReadFile(out); string(data) != "previous\n" {
+			t.Errorf("%v changed --stdout-file to %q", flag, data)
+		}
+	}
+
+	if output, code := runWrapper(t, "-q", "--stdout-file", out, "--build-info-file", build, "proj", "abcdef123456", "--", "echo", "new"); code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, output)
+	}
+	if data, _ := ioutil.ReadFile(out); string(data) != "new\n" {
+		t.Errorf("--stdout-file contains %q, want the process output", data)
+	}
+}
+
+func TestKillAfterKillsProcess(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	started := time.Now()
+	out, code := runWrapper(t, "-q", "--before-timeout", "3s", "--kill-after", "500ms", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "" TERM; while :; do sleep 0.1; done`)
+	if code != 128+9 {
+		t.Errorf("exit code = %d, want %d; output: %s", code, 128+9, out)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("wrapper took %v to kill the process", elapsed)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	defer func(saved *regexp.Regexp) { redactPattern = saved }(redactPattern)
+	redactPattern = regexp.MustCompile(defaultRedactArgs)
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"nothing secret", []string{"apply", "-auto-approve"}, []string{"apply", "-auto-approve"}},
+		{"key value", []string{"--password=hunter2", "x"}, []string{"--password=" + redactedValue, "x"}},
+		{"flag followed by value", []string{"echo", "--password", "hunter2", "x"}, []string{"echo", "--password", redactedValue, "x"}},
+		{"api key flag", []string{"-api-key", "abc"}, []string{"-api-key", redactedValue}},
+		{"flag at end", []string{"--token"}, []string{"--token"}},
+		{"token value", []string{"ghp_abcdef"}, []string{redactedValue}},
+		{"env style key", []string{"DB_PASSWORD=x"}, []string{"DB_PASSWORD=" + redactedValue}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactArgs(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLead(t *testing.T) {
+	tests := []struct {
+		value       string
+		wantDur     time.Duration
+		wantPercent float64
+		wantErr     bool
+	}{
+		{"60s", time.Minute, 0, false},
+		{"2m30s", 150 * time.Second, 0, false},
+		{"10%", 0, 10, false},
+		{"12.5%", 0, 12.5, false},
+		{"0%", 0, 0, true},
+		{"100%", 0, 0, true},
+		{"x%", 0, 0, true},
+		{"5", 0, 0, true},
+	}
+	for _, tt := range tests {
+		dur, percent, err := parseLead(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLead(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+		} else if !tt.wantErr && (dur != tt.wantDur || percent != tt.wantPercent) {
+			t.Errorf("parseLead(%q) = %v, %v; want %v, %v", tt.value, dur, percent, tt.wantDur, tt.wantPercent)
+		}
+	}
+}
+
+func TestBeforeTimeoutListValidation(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	tests := []struct {
+		leads   string
+		wantErr string
+	}{
+		{"2m,30s", ""},
+		{"20%,10%", ""},
+		{"30s,2m", "strictly decreasing"},
+		{"10%,20%", "strictly decreasing"},
+		{"20%,30s", "all durations or all percentages"},
+	}
+	for _, tt := range tests {
+		out, code := runWrapper(t, "--validate", "--signal", "SIGINT,SIGTERM", "--before-timeout", tt.leads, "--build-info-file", path, "proj", "abcdef123456", "--", "true")
+		if tt.wantErr == "" && code != 0 {
+			t.Errorf("%v: exit code = %d; output: %s", tt.leads, code, out)
+		} else if tt.wantErr != "" && (code == 0 || !strings.Contains(out, tt.wantErr)) {
+			t.Errorf("%v: exit code = %d, output %q; want an error containing %q", tt.leads, code, out, tt.wantErr)
+		}
+	}
+}
+
+func TestSignalLead(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	savedRemaining, savedTimeout, savedPercent := remainingPercent, timeoutDur, timeoutPercent
+	savedMinLead, savedMaxLead := minLeadDur, maxLeadDur
+	defer func() {
+		remainingPercent, timeoutDur, timeoutPercent = savedRemaining, savedTimeout, savedPercent
+		minLeadDur, maxLeadDur = savedMinLead, savedMaxLead
+	}()
+
+	tests := []struct {
+		name             string
+		remainingPercent float64
+		timeoutDur       time.Duration
+		timeoutPercent   float64
+		maxLead          time.Duration
+		want             time.Duration
+	}{
+		{"before-timeout duration", 0, time.Minute, 0, 0, time.Minute},
+		{"before-timeout percentage", 0, 0, 10, 0, time.Minute},
+		{"remaining percent", 10, time.Minute, 0, 0, 30 * time.Second},
+		{"remaining percent clamped", 10, time.Minute, 0, 10 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remainingPercent, timeoutDur, timeoutPercent = tt.remainingPercent, tt.timeoutDur, tt.timeoutPercent
+			minLeadDur, maxLeadDur = 0, tt.maxLead
+			// a 10 minute build with 5 minutes left
+			if got := signalLead(10*time.Minute, now.Add(5*time.Minute), now); got != tt.want {
+				t.Errorf("signalLead = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileBuildStatus(t *testing.T) {
+	tests := []struct {
+		status  string
+		command string
+		want    string
+	}{
+		{"WORKING", "true", "still running"},
+		{"CANCELLED", "true", "build status is CANCELLED"},
+		{"FAILURE", "false", "Build status is FAILURE"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "build.json")
+		start := time.Now().UTC().Format(time.RFC3339)
+		content := fmt.Sprintf(`{"id":"abcdef123456","startTime":%q,"timeout":"600s","status":%q}`, start, tt.status)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, _ := runWrapper(t, "-v", "--reconcile-build-status", "--build-info-file", path, "proj", "abcdef123456", "--", tt.command)
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%v: output %q doesn't contain %q", tt.status, out, tt.want)
+		}
+	}
+}
+
+// jsonLogEntries parses the JSON log entries in out, skipping any other output.
+func jsonLogEntries(out string) []map[string]string {
+	var entries []map[string]string
+	for _, line := range strings.Split(out, "\n") {
+		var entry map[string]string
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestSignalToExitDuration(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	out, _ := runWrapper(t, "--log-format", "json", "--before-timeout", "3s", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "sleep 0.2; exit 0" TERM; while :; do sleep 0.1; done`)
+
+	for _, entry := range jsonLogEntries(out) {
+		value, ok := entry["signal_to_exit_duration"]
+		if !ok {
+			continue
+		}
+		dur, err := time.ParseDuration(value)
+		if err != nil || dur < 0 || dur > 5*time.Second {
+			t.Errorf("signal_to_exit_duration = %q, want a short, non-negative duration", value)
+		}
+		return
+	}
+	t.Errorf("no signal_to_exit_duration logged in %q", out)
+}
+
+func TestChildExitDetailsFields(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "--log-format", "json", "--log-child-exit-details", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", "i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done")
+	if code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, out)
+	}
+
+	for _, entry := range jsonLogEntries(out) {
+		if entry["message"] != "Child process exited" {
+			continue
+		}
+		user, err := time.ParseDuration(entry["user_cpu_time"])
+		if err != nil || user <= 0 {
+			t.Errorf("user_cpu_time = %q, want a positive duration for a compute-bound process", entry["user_cpu_time"])
+		}
+		if _, err := time.ParseDuration(entry["system_cpu_time"]); err != nil {
+			t.Errorf("system_cpu_time = %q: %v", entry["system_cpu_time"], err)
+		}
+		if entry["exit_status"] != "exit status 0" {
+			t.Errorf("exit_status = %q", entry["exit_status"])
+		}
+		return
+	}
+	t.Errorf("no child exit details logged in %q", out)
+}
+
+func TestJitterSignalTime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		signal   time.Duration
+		window   time.Duration
+		earliest time.Duration
+	}{
+		{"no window", 10 * time.Minute, 0, 10 * time.Minute},
+		{"within window", 10 * time.Minute, time.Minute, 9 * time.Minute},
+		{"window limited to now", 30 * time.Second, time.Minute, 0},
+		{"signal time already reached", 0, time.Minute, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signalTime := now.Add(tt.signal)
+			got := jitterSignalTime(signalTime, tt.window, now)
+			if got.After(signalTime) || got.Before(now.Add(tt.earliest)) {
+				t.Errorf("jittered signal time %v is outside [%v, %v]", got.Sub(now), tt.earliest, tt.signal)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	marker := filepath.Join(t.TempDir(), "ran")
+	out, code := runWrapper(t, "--validate", "--signal", "SIGBOGUS", "--kill-after", "soon", "--build-info-file", path, "proj", "abcdef123456", "--", "touch", marker)
+	if code == 0 {
+		t.Errorf("exit code = 0 for invalid flags; output: %s", out)
+	}
+	for _, want := range []string{"SIGBOGUS", "--kill-after"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %q doesn't report the problem with %v", out, want)
+		}
+	}
+
+	out, code = runWrapper(t, "--validate", "--build-info-file", path, "proj", "abcdef123456", "--", "touch", marker)
+	if code != 0 || !strings.Contains(out, "Configuration is valid") {
+		t.Errorf("exit code = %d, output %q; want a valid configuration", code, out)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("--validate ran the command")
+	}
+}
+
+func TestWriteExportFile(t *testing.T) {
+	deadline := time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)
+	signalTime := deadline.Add(-time.Minute)
+	path := filepath.Join(t.TempDir(), "deadline.env")
+
+	if err := writeExportFile(path, deadline, signalTime); err != nil {
+		t.Fatalf("writeExportFile: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "export WRAPPER_DEADLINE='2020-01-01T01:00:00Z'\n" +
+		"export WRAPPER_DEADLINE_UNIX=1577840400\n" +
+		"export WRAPPER_SIGNAL_TIME='2020-01-01T00:59:00Z'\n" +
+		"export WRAPPER_SIGNAL_TIME_UNIX=1577840340\n"
+	if string(data) != want {
+		t.Errorf("export file contains %q, want %q", data, want)
+	}
+
+	if err := writeExportFile(filepath.Join(path, "nested"), deadline, signalTime); err == nil {
+		t.Error("writeExportFile to an unwritable path succeeded")
+	}
+}
+
+func TestTimeoutReportOnStderr(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	cmd := exec.Command(os.Args[0], "--before-timeout", "3s", "--step-name", "deploy", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "exit 0" TERM; while :; do sleep 0.1; done`)
+	cmd.Env = append(os.Environ(), "GCBCW_TEST_MAIN=1")
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("running wrapper: %v; stderr: %s", err, stderr.String())
+	}
+
+	report := "The Cloud Build timeout for build abcdef123456, step deploy, is about to be reached."
+	if !strings.Contains(stderr.String(), report) {
+		t.Errorf("stderr %q doesn't contain the timeout report", stderr.String())
+	}
+	if strings.Contains(stdout.String(), report) {
+		t.Error("timeout report was written to stdout")
+	}
+}
+
+func TestAPIMockFileDryRun(t *testing.T) {
+	path := writeBuildInfo(t, time.Minute, 10*time.Minute)
+	out, code := runWrapper(t, "--dry-run", "--api-mock-file", path, "proj", "abcdef123456", "--", "true")
+	if code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, out)
+	}
+	for _, want := range []string{"Build timeout: 10m0s", "(1m0s before the deadline)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %q doesn't contain %q", out, want)
+		}
+	}
+}
+
+func TestDeadlineBase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.json")
+	now := time.Now().UTC()
+	content := fmt.Sprintf(`{"id":"abcdef123456","createTime":%q,"startTime":%q,"timeout":"600s"}`,
+		now.Add(-5*time.Minute).Format(time.RFC3339), now.Format(time.RFC3339))
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		base     string
+		deadline time.Time
+	}{
+		{"start", now.Add(10 * time.Minute)},
+		{"create", now.Add(5 * time.Minute)},
+	}
+	for _, tt := range tests {
+		out, code := runWrapper(t, "--dry-run", "--deadline-base", tt.base, "--build-info-file", path, "proj", "abcdef123456", "--", "true")
+		if code != 0 {
+			t.Fatalf("%v: exit code = %d; output: %s", tt.base, code, out)
+		}
+		if want := "Build deadline: " + tt.deadline.Truncate(time.Second).Local().String(); !strings.Contains(out, want) {
+			t.Errorf("%v: output %q doesn't contain %q", tt.base, out, want)
+		}
+	}
+}
+
+func TestCanonicalSignalName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"SIGTERM", "SIGTERM", false},
+		{"SIGIOT", "SIGABRT", false},
+		{"SIGPOLL", "SIGIO", false},
+		{"SIGBOGUS", "", true},
+		{"TERM", "", true},
+	}
+	for _, tt := range tests {
+		got, err := canonicalSignalName(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("canonicalSignalName(%q) = %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	aliases := filepath.Join(t.TempDir(), "aliases.json")
+	if err := ioutil.WriteFile(aliases, []byte(`{"slow": {"before-timeout": "2m"}, "bad": {"no-such-flag": "1"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"preset applied", []string{"--alias", "slow"}, "(2m0s before the deadline)"},
+		{"command line wins", []string{"--alias", "slow", "--before-timeout", "30s"}, "(30s before the deadline)"},
+		{"unknown alias", []string{"--alias", "fast"}, "alias 'fast' not found"},
+		{"unknown flag", []string{"--alias", "bad"}, "unknown flag --no-such-flag"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"--dry-run", "--alias-file", aliases, "--build-info-file", build}, tt.args...)
+		out, _ := runWrapper(t, append(args, "proj", "abcdef123456", "--", "true")...)
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%v: output %q doesn't contain %q", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestCheckTimingBudget(t *testing.T) {
+	savedJitter, savedKillAfter := jitterDur, killAfterDur
+	savedDiagnostic, savedGrace := diagnosticSigStr, diagnosticGraceDur
+	defer func() {
+		jitterDur, killAfterDur = savedJitter, savedKillAfter
+		diagnosticSigStr, diagnosticGraceDur = savedDiagnostic, savedGrace
+	}()
+
+	tests := []struct {
+		name       string
+		lead       time.Duration
+		jitter     time.Duration
+		killAfter  time.Duration
+		diagnostic string
+		wantErr    bool
+	}{
+		{"fits", time.Minute, 10 * time.Second, time.Minute, "", false},
+		{"lead alone too long", 10 * time.Minute, 0, 0, "", true},
+		{"combined too long", 5 * time.Minute, 2 * time.Minute, 3 * time.Minute, "", true},
+		{"fits without diagnostic grace", 5 * time.Minute, 0, 4 * time.Minute, "", false},
+		{"diagnostic grace too long", 5 * time.Minute, 0, 4 * time.Minute, "SIGQUIT", true},
+	}
+	for _, tt := range tests {
+		jitterDur, killAfterDur = tt.jitter, tt.killAfter
+		diagnosticSigStr, diagnosticGraceDur = tt.diagnostic, 2*time.Minute
+		if err := checkTimingBudget(10*time.Minute, tt.lead); (err != nil) != tt.wantErr {
+			t.Errorf("%v: checkTimingBudget error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExitCodeFile(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"process exit code", []string{"--build-info-file", build, "proj", "abcdef123456", "--", "sh", "-c", "exit 3"}, "3\n"},
+		{"success", []string{"--build-info-file", build, "proj", "abcdef123456", "--", "true"}, "0\n"},
+		{"invalid flags", []string{"--signal", "SIGBOGUS", "--build-info-file", build, "proj", "abcdef123456", "--", "true"}, "1\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "exit-code")
+		runWrapper(t, append([]string{"-q", "--exit-code-file", path}, tt.args...)...)
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != tt.want {
+			t.Errorf("%v: exit code file contains %q (%v), want %q", tt.name, data, err, tt.want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be read while a running wrapper writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startWrapper starts the wrapper with args, returning it running with its combined
+// output going to the returned buffer.
+func startWrapper(t *testing.T, args ...string) (*exec.Cmd, *syncBuffer) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GCBCW_TEST_MAIN=1")
+	out := &syncBuffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting wrapper: %v", err)
+	}
+	return cmd, out
+}
+
+// exitCode returns the exit code of a wrapper started by startWrapper once it exits.
+func exitCode(t *testing.T, cmd *exec.Cmd) int {
+	t.Helper()
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("waiting for wrapper: %v", err)
+	}
+	return 0
+}
+
+func TestKeepaliveOnSighup(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	for _, keepalive := range []bool{false, true} {
+		cmd, out := startWrapper(t, "-q", fmt.Sprintf("--keepalive-on-sighup=%v", keepalive), "--build-info-file", build, "proj", "abcdef123456", "--",
+			"sh", "-c", "sleep 1; echo done")
+		time.Sleep(400 * time.Millisecond)
+		_ = cmd.Process.Signal(syscall.SIGHUP)
+
+		code := exitCode(t, cmd)
+		if keepalive && (code != 0 || !strings.Contains(out.String(), "done")) {
+			t.Errorf("with --keepalive-on-sighup: exit code = %d, output %q; want the process to finish", code, out.String())
+		} else if !keepalive && code != 128+int(syscall.SIGHUP) {
+			t.Errorf("without --keepalive-on-sighup: exit code = %d, want the process to be hung up", code)
+		}
+	}
+}
+
+func TestIDsFromFlags(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "--dry-run", "--project-id", "proj", "--build-id", "abcdef123456", "--build-info-file", build, "--", "true")
+	if code != 0 || !strings.Contains(out, "Build timeout: 10m0s") {
+		t.Errorf("exit code = %d, output %q; want the schedule", code, out)
+	}
+
+	// with nothing to fall back on in the environment either
+	out, code = runWrapperWithEnv(t, []string{"PROJECT_ID=", "BUILD_ID="}, "--validate", "--project-id", "proj", "--build-info-file", build, "--", "true")
+	if code == 0 {
+		t.Errorf("exit code = 0 without a build ID; output: %s", out)
+	}
+}
+
+func TestIDsFromEnvironment(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	env := []string{"PROJECT_ID=proj", "BUILD_ID=abcdef123456"}
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+	}{
+		{"command only", env, []string{"--", "true"}},
+		{"positional with environment set", env, []string{"proj", "abcdef123456", "--", "true"}},
+		{"positional without environment", []string{"PROJECT_ID=", "BUILD_ID="}, []string{"proj", "abcdef123456", "--", "true"}},
+	}
+	for _, tt := range tests {
+		out, code := runWrapperWithEnv(t, tt.env, append([]string{"--dry-run", "--build-info-file", build}, tt.args...)...)
+		if code != 0 || !strings.Contains(out, "Build timeout: 10m0s") {
+			t.Errorf("%v: exit code = %d, output %q; want the schedule", tt.name, code, out)
+		}
+	}
+
+	out, code := runWrapperWithEnv(t, []string{"PROJECT_ID=", "BUILD_ID="}, "--validate", "--build-info-file", build, "--", "true")
+	if code == 0 {
+		t.Errorf("exit code = 0 with no IDs anywhere; output: %s", out)
+	}
+}
+
+func TestDumpFlags(t *testing.T) {
+	out, code := runWrapper(t, "--dump-flags", "json")
+	if code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, out)
+	}
+
+	var flags []flagDefinition
+	if err := json.Unmarshal([]byte(out), &flags); err != nil {
+		t.Fatalf("output isn't a JSON list of flags: %v", err)
+	}
+	byName := map[string]flagDefinition{}
+	for _, f := range flags {
+		byName[f.Name] = f
+	}
+	if f := byName["before-timeout"]; f.Shorthand != "t" || f.Default != "60s" || f.Type != "string" {
+		t.Errorf("before-timeout is described as %+v", f)
+	}
+	if f := byName["api-mock-file"]; !f.Hidden {
+		t.Errorf("api-mock-file is described as %+v, want it hidden", f)
+	}
+}
+
+func TestTeeFd(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	tee, err := ioutil.TempFile(t.TempDir(), "tee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tee.Close()
+
+	// ExtraFiles start at descriptor 3
+	cmd := exec.Command(os.Args[0], "-q", "--tee-fd", "3", "--build-info-file", build, "proj", "abcdef123456", "--", "sh", "-c", "echo out; echo err >&2")
+	cmd.Env = append(os.Environ(), "GCBCW_TEST_MAIN=1")
+	cmd.ExtraFiles = []*os.File{tee}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("running wrapper: %v; output: %s", err, out)
+	}
+
+	data, err := ioutil.ReadFile(tee.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"out\n", "err\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("--tee-fd got %q, missing %q", data, want)
+		}
+	}
+
+	if out, code := runWrapper(t, "--validate", "--tee-fd", "97", "--build-info-file", build, "proj", "abcdef123456", "--", "true"); code == 0 {
+		t.Errorf("exit code = 0 for a descriptor that isn't open; output: %s", out)
+	}
+}
+
+func TestAutoSafetyMargin(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "--dry-run", "--auto-safety-margin", "--build-info-file", build, "proj", "abcdef123456", "--", "true")
+	if code != 0 || !strings.Contains(out, "Applied safety margin of") {
+		t.Errorf("exit code = %d, output %q; want the safety margin applied", code, out)
+	}
+
+	out, _ = runWrapper(t, "--dry-run", "--build-info-file", build, "proj", "abcdef123456", "--", "true")
+	if strings.Contains(out, "safety margin") {
+		t.Errorf("safety margin applied without --auto-safety-margin: %q", out)
+	}
+}
+
+func TestStartErrorExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		want   int
+		wantOk bool
+	}{
+		{"not in PATH", &exec.Error{Name: "x", Err: exec.ErrNotFound}, 127, true},
+		{"no such file", &os.PathError{Op: "fork/exec", Path: "/x", Err: syscall.ENOENT}, 127, true},
+		{"permission denied", &os.PathError{Op: "fork/exec", Path: "/x", Err: syscall.EACCES}, 126, true},
+		{"not executable format", &os.PathError{Op: "fork/exec", Path: "/x", Err: syscall.ENOEXEC}, 126, true},
+		{"other error", errors.New("boom"), 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := startErrorExitCode(tt.err); got != tt.want || ok != tt.wantOk {
+			t.Errorf("%v: startErrorExitCode = %d, %v; want %d, %v", tt.name, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestStartErrorExitsLikeShell(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	script := filepath.Join(t.TempDir(), "script")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		want    int
+	}{
+		{"not found", "no-such-command-gcbcw", 127},
+		{"not executable", script, 126},
+		{"directory", t.TempDir(), 126},
+	}
+	for _, tt := range tests {
+		if out, code := runWrapper(t, "--build-info-file", build, "proj", "abcdef123456", "--", tt.command); code != tt.want {
+			t.Errorf("%v: exit code = %d, want %d; output: %s", tt.name, code, tt.want, out)
+		}
+	}
+
+	// the process's own exit code is passed through unchanged, even if it's one of these
+	if out, code := runWrapper(t, "--build-info-file", build, "proj", "abcdef123456", "--", "sh", "-c", "exit 127"); code != 127 || strings.Contains(out, "Unable to start") {
+		t.Errorf("exit code = %d, output %q; want the process's own 127", code, out)
+	}
+}
+
+func TestHoldStdinOpen(t *testing.T) {
+	if _, err := exec.LookPath("timeout"); err != nil {
+		t.Skip("timeout command not available")
+	}
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	// timeout exits 124 if cat is still waiting for input when it expires
+	script := "timeout 0.5 cat; echo status=$?"
+
+	out, _ := runWrapper(t, "-q", "--hold-stdin-open", "--build-info-file", build, "proj", "abcdef123456", "--", "sh", "-c", script)
+	if !strings.Contains(out, "status=124") {
+		t.Errorf("with --hold-stdin-open: output %q, want stdin to stay open", out)
+	}
+
+	out, _ = runWrapper(t, "-q", "--build-info-file", build, "proj", "abcdef123456", "--", "sh", "-c", script)
+	if !strings.Contains(out, "status=0") {
+		t.Errorf("without --hold-stdin-open: output %q, want EOF from the wrapper's empty stdin", out)
+	}
+}
+
+func TestStepName(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+		want string
+	}{
+		{"from flag", []string{"BUILD_STEP=env-step"}, []string{"--step-name", "flag-step"}, "INFO: [flag-step] "},
+		{"from environment", []string{"BUILD_STEP=env-step"}, nil, "INFO: [env-step] "},
+		{"none", []string{"BUILD_STEP="}, nil, "INFO: 20"},
+	}
+	for _, tt := range tests {
+		args := append(append([]string{}, tt.args...), "--build-info-file", build, "proj", "abcdef123456", "--", "true")
+		out, code := runWrapperWithEnv(t, tt.env, args...)
+		if code != 0 || !strings.HasPrefix(out, tt.want) {
+			t.Errorf("%v: exit code = %d, output %q; want it to start with %q", tt.name, code, out, tt.want)
+		}
+	}
+
+	out, _ := runWrapperWithEnv(t, []string{"BUILD_STEP=env-step"}, "--log-format", "json", "--build-info-file", build, "proj", "abcdef123456", "--", "true")
+	if entries := jsonLogEntries(out); len(entries) == 0 || entries[0]["step"] != "env-step" {
+		t.Errorf("JSON log entries %v don't include the step", entries)
+	}
+}
+
+func TestClampLead(t *testing.T) {
+	savedMin, savedMax := minLeadDur, maxLeadDur
+	defer func() { minLeadDur, maxLeadDur = savedMin, savedMax }()
+
+	tests := []struct {
+		name    string
+		lead    time.Duration
+		minLead time.Duration
+		maxLead time.Duration
+		want    time.Duration
+	}{
+		{"no limits", time.Minute, 0, 0, time.Minute},
+		{"within limits", time.Minute, 30 * time.Second, 2 * time.Minute, time.Minute},
+		{"raised to minimum", 10 * time.Second, 30 * time.Second, 0, 30 * time.Second},
+		{"lowered to maximum", 5 * time.Minute, 0, 2 * time.Minute, 2 * time.Minute},
+		{"at the limits", 2 * time.Minute, 2 * time.Minute, 2 * time.Minute, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		minLeadDur, maxLeadDur = tt.minLead, tt.maxLead
+		if got := clampLead(tt.lead); got != tt.want {
+			t.Errorf("%v: clampLead(%v) = %v, want %v", tt.name, tt.lead, got, tt.want)
+		}
+	}
+}
+
+func TestBeforeTimeoutLead(t *testing.T) {
+	savedDur, savedPercent := timeoutDur, timeoutPercent
+	defer func() { timeoutDur, timeoutPercent = savedDur, savedPercent }()
+
+	tests := []struct {
+		name    string
+		dur     time.Duration
+		percent float64
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"duration", 90 * time.Second, 0, 10 * time.Minute, 90 * time.Second},
+		{"percentage", 0, 10, 10 * time.Minute, time.Minute},
+		{"fractional percentage", 0, 2.5, time.Hour, 90 * time.Second},
+	}
+	for _, tt := range tests {
+		timeoutDur, timeoutPercent = tt.dur, tt.percent
+		if got := beforeTimeoutLead(tt.timeout); got != tt.want {
+			t.Errorf("%v: beforeTimeoutLead(%v) = %v, want %v", tt.name, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestLogScheduleSummary(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	savedLogger, savedDeadline, savedTimeout, savedSignal := InfoLogger, buildDeadline, buildTimeout, timeoutSigStr
+	defer func() {
+		InfoLogger, buildDeadline, buildTimeout, timeoutSigStr = savedLogger, savedDeadline, savedTimeout, savedSignal
+	}()
+
+	var out bytes.Buffer
+	InfoLogger = log.New(&out, "", 0)
+	buildTimeout, buildDeadline, timeoutSigStr = 10*time.Minute, now.Add(7*time.Minute), "SIGTERM"
+
+	logScheduleSummary(now, now.Add(6*time.Minute))
+	if want := "Build timeout 10m0s, elapsed 3m0s, remaining 7m0s; will signal SIGTERM in 6m0s\n"; out.String() != want {
+		t.Errorf("logged %q, want %q", out.String(), want)
+	}
+}
+
+func TestEverySignalForwarded(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	cmd, out := startWrapper(t, "-q", "--build-info-file", build, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap 'echo usr1' USR1; trap 'echo term; exit 0' TERM; echo ready; while :; do sleep 0.1; done`)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "ready") && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, sig := range []os.Signal{syscall.SIGUSR1, syscall.SIGUSR1, syscall.SIGTERM} {
+		_ = cmd.Process.Signal(sig)
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	if code := exitCode(t, cmd); code != 0 {
+		t.Errorf("exit code = %d; output: %s", code, out.String())
+	}
+	if got := strings.Count(out.String(), "usr1"); got != 2 || !strings.Contains(out.String(), "term") {
+		t.Errorf("process output %q; want both SIGUSR1 and then SIGTERM forwarded", out.String())
+	}
+}
+
+func TestTimedOutExitCode(t *testing.T) {
+	savedTimedOut, savedKilled := processTimedOut, processKilled
+	savedGraceful, savedTimeoutCode := gracefulExitCode, timeoutExitCode
+	defer func() {
+		processTimedOut, processKilled = savedTimedOut, savedKilled
+		gracefulExitCode, timeoutExitCode = savedGraceful, savedTimeoutCode
+	}()
+
+	tests := []struct {
+		name        string
+		timedOut    bool
+		killed      bool
+		graceful    int
+		timeoutCode int
+		want        int
+		wantOK      bool
+	}{
+		{"not timed out", false, false, 0, 124, 0, false},
+		{"nothing configured", true, false, -1, 0, 0, false},
+		{"timeout exit code", true, false, -1, 124, 124, true},
+		{"graceful exit", true, false, 0, 124, 0, true},
+		{"killed after graceful period", true, true, 0, 124, 124, true},
+		{"killed without timeout exit code", true, true, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		processTimedOut, processKilled = tt.timedOut, tt.killed
+		gracefulExitCode, timeoutExitCode = tt.graceful, tt.timeoutCode
+		if got, ok := timedOutExitCode(); got != tt.want || ok != tt.wantOK {
+			t.Errorf("%v: timedOutExitCode() = %d, %v; want %d, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestGracefulExitCode(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	out, code := runWrapper(t, "-q", "--before-timeout", "3s", "--graceful-exit-code", "0", "--timeout-exitcode", "124",
+		"--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "exit 3" TERM; while :; do sleep 0.1; done`)
+	if code != 0 {
+		t.Errorf("exit code = %d, want --graceful-exit-code 0; output: %s", code, out)
+	}
+}
+
+func TestSignaledProcessExitCode(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	out, code := runWrapper(t, "-q", "--before-timeout", "3s", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `exec sleep 30`)
+	if code != 128+int(syscall.SIGTERM) {
+		t.Errorf("exit code = %d, want %d; output: %s", code, 128+int(syscall.SIGTERM), out)
+	}
+}
+
+func TestParseDeadlineSubstitution(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"RFC 3339 time", "2020-01-01T01:30:00Z", base.Add(90 * time.Minute), false},
+		{"RFC 3339 time with offset", "2020-01-01T02:00:00+01:00", base.Add(time.Hour), false},
+		{"duration", "45m", base.Add(45 * time.Minute), false},
+		{"neither", "tomorrow", time.Time{}, true},
+		{"empty", "", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDeadlineSubstitution(tt.value, base)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("%v: parseDeadlineSubstitution(%q) = %v, %v; want %v, error %v", tt.name, tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestShortBuildId(t *testing.T) {
+	savedId, savedLength := buildId, shortIdLength
+	defer func() { buildId, shortIdLength = savedId, savedLength }()
+
+	tests := []struct {
+		id     string
+		length int
+		want   string
+	}{
+		{"abcdef12-3456-7890", 8, "abcdef12"},
+		{"abcdef12-3456-7890", 100, "abcdef12-3456-7890"},
+		{"abc", 3, "abc"},
+		{"", 8, ""},
+	}
+	for _, tt := range tests {
+		buildId, shortIdLength = tt.id, tt.length
+		if got := shortBuildId(); got != tt.want {
+			t.Errorf("shortBuildId() with ID %q and length %d = %q, want %q", tt.id, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestWorkdirFromEnv(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := runWrapperWithEnv(t, []string{"STEP_DIR=" + dir}, "-q", "--workdir-from-env", "STEP_DIR",
+		"--build-info-file", build, "proj", "abcdef123456", "--", "pwd")
+	if code != 0 || strings.TrimSpace(out) != dir {
+		t.Errorf("exit code = %d, output %q; want the process run in %v", code, out, dir)
+	}
+
+	out, code = runWrapperWithEnv(t, []string{"STEP_DIR="}, "-q", "--workdir-from-env", "STEP_DIR",
+		"--build-info-file", build, "proj", "abcdef123456", "--", "pwd")
+	if code == 0 || !strings.Contains(out, "environment variable STEP_DIR is not set") {
+		t.Errorf("exit code = %d, output %q; want an unset variable reported", code, out)
+	}
+}
+
+func TestChildExitGrace(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	started := time.Now()
+	// the background sleep keeps the output open after the process itself exits
+	out, code := runWrapper(t, "--timestamp-output", "--child-exit-grace", "200ms", "--build-info-file", build, "proj", "abcdef123456", "--",
+		"sh", "-c", "sleep 30 & echo done")
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0; output: %s", code, out)
+	}
+	if !strings.Contains(out, "done") || !strings.Contains(out, "no longer waiting for it") {
+		t.Errorf("output %q; want the process output and a warning about its output still being open", out)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("wrapper took %v to exit", elapsed)
+	}
+}
+
+func TestExitCodeAfterTimeoutSignal(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	out, code := runWrapper(t, "-q", "--before-timeout", "3s", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "exit 5" TERM; while :; do sleep 0.1; done`)
+	if code != 5 {
+		t.Errorf("exit code = %d, want the process's own exit code 5; output: %s", code, out)
+	}
+}
+
+func TestLogCountdown(t *testing.T) {
+	savedLogger, savedQuiet := InfoLogger, quiet
+	savedDeadline, savedTimeout, savedSignal := buildDeadline, buildTimeout, timeoutSigStr
+	defer func() {
+		InfoLogger, quiet = savedLogger, savedQuiet
+		buildDeadline, buildTimeout, timeoutSigStr = savedDeadline, savedTimeout, savedSignal
+	}()
+
+	out := &syncBuffer{}
+	InfoLogger = log.New(out, "", 0)
+	quiet = false
+	buildTimeout, buildDeadline, timeoutSigStr = time.Hour, time.Now().Add(50*time.Minute), "SIGTERM"
+
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	logCountdown(time.Now().Add(40*time.Minute), 20*time.Millisecond, stop)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if want := "Build has been running for 10m0s; 40m0s until the process is sent SIGTERM"; lines[0] != want {
+		t.Errorf("logged %q, want lines of %q", out.String(), want)
+	}
+}
+
+func TestJSONProcessOutputIsNDJSON(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	out, code := runWrapper(t, "--log-format", "json", "--json-process-output", "--build-info-file", build, "proj", "abcdef123456", "--",
+		"sh", "-c", `echo hello; echo '{"message":"structured"}'; echo oops >&2; printf partial`)
+	if code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, out)
+	}
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("output line %q isn't JSON: %v", line, err)
+		}
+		if entry["stream"] != nil {
+			messages = append(messages, entry["message"].(string))
+		}
+	}
+	// stdout and stderr are relayed independently, so only their own order is kept
+	sort.Strings(messages)
+	if got, want := strings.Join(messages, ","), "hello,oops,partial,structured"; got != want {
+		t.Errorf("process output messages = %q, want %q", got, want)
+	}
+}
+
+func TestJSONProcessOutputTimeoutIsNDJSON(t *testing.T) {
+	build := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	out, code := runWrapper(t, "--log-format", "json", "--json-process-output", "--before-timeout", "3s",
+		"--pre-signal-hook", "echo hook output; echo hook error >&2", "--build-info-file", build, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "exit 0" TERM; while :; do sleep 0.1; done`)
+	if code != 0 {
+		t.Fatalf("exit code = %d; output: %s", code, out)
+	}
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("output line %q isn't JSON: %v", line, err)
+		}
+		messages = append(messages, entry["message"].(string))
+	}
+	all := strings.Join(messages, "\n")
+	for _, want := range []string{"hook output", "hook error", "is about to be reached"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("no entry with %q in %q", want, all)
+		}
+	}
+}
+
+func TestEscalateIfSilent(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		wantCode int
+	}{
+		{"silent process killed", `trap "" TERM; while :; do sleep 0.1; done`, 128 + 9},
+		{"process still writing left alone", `trap "for i in 1 2 3 4 5 6 7 8; do echo busy; sleep 0.1; done; exit 0" TERM; while :; do sleep 0.1; done`, 0},
+	}
+	for _, tt := range tests {
+		path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+		started := time.Now()
+		out, code := runWrapper(t, "-q", "--before-timeout", "3s", "--escalate-if-silent", "300ms", "--build-info-file", path, "proj", "abcdef123456", "--",
+			"sh", "-c", tt.script)
+		if code != tt.wantCode {
+			t.Errorf("%v: exit code = %d, want %d; output: %s", tt.name, code, tt.wantCode, out)
+		}
+		if elapsed := time.Since(started); elapsed > 5*time.Second {
+			t.Errorf("%v: wrapper took %v to exit", tt.name, elapsed)
+		}
+	}
+}
+
+func TestDiagnosticSignalBeforeKill(t *testing.T) {
+	path := writeBuildInfo(t, 10*time.Minute-4*time.Second, 10*time.Minute)
+	out, code := runWrapper(t, "--before-timeout", "3s", "--kill-after", "300ms", "--diagnostic-signal", "SIGQUIT", "--diagnostic-grace", "300ms",
+		"--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "" TERM; trap "echo thread dump" QUIT; while :; do sleep 0.1; done`)
+	if code != 128+9 {
+		t.Errorf("exit code = %d, want %d; output: %s", code, 128+9, out)
+	}
+	dump, killed := strings.Index(out, "thread dump"), strings.Index(out, "of the diagnostic signal; sending SIGKILL")
+	if dump < 0 || killed < 0 || dump > killed {
+		t.Errorf("output %q; want the diagnostic signal handled before SIGKILL is sent", out)
+	}
+}
+
+func TestPollDelay(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	savedMin, savedMax, savedDeadline := pollIntervalDur, pollIntervalMaxDur, buildDeadline
+	defer func() { pollIntervalDur, pollIntervalMaxDur, buildDeadline = savedMin, savedMax, savedDeadline }()
+
+	tests := []struct {
+		name      string
+		max       time.Duration
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{"fixed interval", 0, 10 * time.Hour, 30 * time.Second},
+		{"far from the deadline", 10 * time.Minute, 10 * time.Hour, 10 * time.Minute},
+		{"nearing the deadline", 10 * time.Minute, time.Hour, 6 * time.Minute},
+		{"close to the deadline", 10 * time.Minute, 2 * time.Minute, 30 * time.Second},
+		{"past the deadline", 10 * time.Minute, -time.Minute, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		pollIntervalDur, pollIntervalMaxDur, buildDeadline = 30*time.Second, tt.max, now.Add(tt.remaining)
+		if got := pollDelay(now); got != tt.want {
+			t.Errorf("%v: pollDelay with %v remaining = %v, want %v", tt.name, tt.remaining, got, tt.want)
+		}
+	}
+}
+
+func TestMaxOutputRate(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+
+	out, code := runWrapper(t, "--max-output-line-rate", "10", "--output-rate-window", "200ms", "--build-info-file", build, "proj", "abcdef123456", "--",
+		"sh", "-c", `i=0; while [ $i -lt 100 ]; do echo line; i=$((i+1)); done; sleep 0.5`)
+	if code != 0 || !strings.Contains(out, "Process is writing output too fast") {
+		t.Errorf("exit code = %d; want a warning about the output rate and the process left running; output: %s", code, out)
+	}
+
+	started := time.Now()
+	out, code = runWrapper(t, "-q", "--max-output-rate", "1000", "--output-rate-window", "200ms", "--output-rate-signal", "SIGTERM",
+		"--build-info-file", build, "proj", "abcdef123456", "--", "sh", "-c", `while :; do echo runaway; done`)
+	if code != 128+int(syscall.SIGTERM) {
+		t.Errorf("exit code = %d, want the process stopped with --output-rate-signal SIGTERM after %d bytes of output", code, len(out))
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("wrapper took %v to signal a runaway process", elapsed)
+	}
+}
+
+func TestTimeoutCombinePolicy(t *testing.T) {
+	build := writeBuildInfo(t, 0, 10*time.Minute)
+	tests := []struct {
+		policy      string
+		fallback    string
+		wantTimeout string
+	}{
+		{"api-preferred", "5m", "Build timeout: 10m0s"},
+		{"fixed-preferred", "5m", "Build timeout: 5m0s"},
+		{"min", "5m", "Build timeout: 5m0s"},
+		{"min", "20m", "Build timeout: 10m0s"},
+		{"max", "5m", "Build timeout: 10m0s"},
+		{"max", "20m", "Build timeout: 20m0s"},
+	}
+	for _, tt := range tests {
+		out, code := runWrapper(t, "--dry-run", "--fallback-timeout", tt.fallback, "--timeout-combine-policy", tt.policy,
+			"--build-info-file", build, "proj", "abcdef123456", "--", "true")
+		if code != 0 || !strings.Contains(out, tt.wantTimeout+"\n") {
+			t.Errorf("%v with --fallback-timeout %v: exit code = %d, output %q; want %q", tt.policy, tt.fallback, code, out, tt.wantTimeout)
+		}
+	}
+
+	out, code := runWrapper(t, "--dry-run", "--timeout-combine-policy", "min", "--build-info-file", build, "proj", "abcdef123456", "--", "true")
+	if code == 0 || !strings.Contains(out, "requires --fallback-timeout") {
+		t.Errorf("exit code = %d, output %q; want --fallback-timeout required", code, out)
+	}
+}
+
+func TestMinRuntimeAfterSignalTimePassed(t *testing.T) {
+	// the default 1m lead put the signal time 30s ago
+	path := writeBuildInfo(t, 570*time.Second, 600*time.Second)
+	started := time.Now()
+	out, code := runWrapper(t, "--min-runtime", "1s", "--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", `trap "echo term; exit 0" TERM; while :; do sleep 0.1; done`)
+	if code != 0 || !strings.Contains(out, "term") {
+		t.Errorf("exit code = %d, output %q; want the process run and then signaled", code, out)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("process was signaled after %v, want after --min-runtime of 1s", elapsed)
+	}
+
+	out, code = runWrapper(t, "--build-info-file", path, "proj", "abcdef123456", "--", "true")
+	if code != 1 || !strings.Contains(out, "occurs in the past") {
+		t.Errorf("exit code = %d, output %q; want a past signal time rejected without --min-runtime", code, out)
+	}
+}
+
+func TestTimingBudgetUsesSubstitutionDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.json")
+	start := time.Now().UTC().Format(time.RFC3339Nano)
+	content := fmt.Sprintf(`{"id":"abcdef123456","startTime":%q,"timeout":"600s","substitutions":{"_DEADLINE":"2m"}}`, start)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 90s plus 60s fits in the build's 10m timeout, but not in the 2m to the substitution deadline
+	out, code := runWrapper(t, "--dry-run", "--deadline-from-substitution", "_DEADLINE", "--before-timeout", "90s", "--kill-after", "60s",
+		"--build-info-file", path, "proj", "abcdef123456", "--", "true")
+	if code != 1 || !strings.Contains(out, "do not fit within the build timeout of 2m0s") {
+		t.Errorf("exit code = %d, output %q; want the budget checked against the substitution deadline", code, out)
+	}
+}
+
+// fakeCloudBuild serves GetBuild, returning statuses in turn, or err when it is set.
+type fakeCloudBuild struct {
+	cloudbuildpb.UnimplementedCloudBuildServer
+	mu       sync.Mutex
+	statuses []cloudbuildpb.Build_Status
+	err      error
+	calls    int
+}
+
+func (f *fakeCloudBuild) GetBuild(ctx context.Context, req *cloudbuildpb.GetBuildRequest) (*cloudbuildpb.Build, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	build := &cloudbuildpb.Build{Id: req.Id, Status: f.statuses[0]}
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+	return build, nil
+}
+
+// countingListener counts the connections made to it.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// useFakeCloudBuild points the API client at f, served in plaintext on loopback.
+func useFakeCloudBuild(t *testing.T, f *fakeCloudBuild) *countingListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on loopback: %v", err)
+	}
+	counting := &countingListener{Listener: listener}
+	server := grpc.NewServer()
+	cloudbuildpb.RegisterCloudBuildServer(server, f)
+	go server.Serve(counting)
+
+	savedEndpoint, savedInsecure, savedFile, savedRetries := apiEndpoint, apiInsecure, buildInfoFile, apiRetries
+	t.Cleanup(func() {
+		server.Stop()
+		apiEndpoint, apiInsecure, buildInfoFile, apiRetries = savedEndpoint, savedInsecure, savedFile, savedRetries
+	})
+	apiEndpoint, apiInsecure, buildInfoFile = listener.Addr().String(), true, ""
+	return counting
+}
+
+func TestWatchBuildStatusReusesClient(t *testing.T) {
+	f := &fakeCloudBuild{statuses: []cloudbuildpb.Build_Status{
+		cloudbuildpb.Build_WORKING, cloudbuildpb.Build_WORKING, cloudbuildpb.Build_CANCELLED,
+	}}
+	listener := useFakeCloudBuild(t, f)
+	savedInterval, savedMax := pollIntervalDur, pollIntervalMaxDur
+	defer func() { pollIntervalDur, pollIntervalMaxDur = savedInterval, savedMax }()
+	pollIntervalDur, pollIntervalMaxDur = 10*time.Millisecond, 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	select {
+	case status := <-watchBuildStatus(ctx):
+		if status != cloudbuildpb.Build_CANCELLED {
+			t.Errorf("got status %v, want %v", status, cloudbuildpb.Build_CANCELLED)
+		}
+	case <-ctx.Done():
+		t.Fatal("watchBuildStatus didn't report the cancelled build")
+	}
+
+	f.mu.Lock()
+	calls := f.calls
+	f.mu.Unlock()
+	if calls != 3 {
+		t.Errorf("build was polled %d times, want 3", calls)
+	}
+	if n := atomic.LoadInt32(&listener.accepted); n != 1 {
+		t.Errorf("polling made %d connections, want the client reused for 1", n)
+	}
+}
+
+func TestFetchBuildRetryStopsOnCancel(t *testing.T) {
+	useFakeCloudBuild(t, &fakeCloudBuild{err: status.Error(codes.Unavailable, "try again")})
+	savedQuiet := quiet
+	defer func() { quiet = savedQuiet }()
+	quiet = true
+	apiRetries = 5
+
+	c, err := newBuildClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := fetchBuild(ctx, c); err == nil {
+		t.Fatal("fetchBuild succeeded against an unavailable API")
+	}
+	// the first retry alone would wait apiRetryBackoff
+	if elapsed := time.Since(start); elapsed >= apiRetryBackoff {
+		t.Errorf("fetchBuild took %v after its context ended", elapsed)
+	}
+}
+
+func TestParallelChildren(t *testing.T) {
+	// each child waits for the other to have started, which only happens when they run at
+	// the same time
+	child := func(dir, name, other string, code int) string {
+		return fmt.Sprintf("touch %[1]s/%[2]s; for i in $(seq 200); do [ -f %[1]s/%[3]s ] && exit %[4]d; sleep 0.05; done; exit 99", dir, name, other, code)
+	}
+
+	tests := []struct {
+		name     string
+		code     int
+		wantCode int
+	}{
+		{"all succeed", 0, 0},
+		{"one fails", 3, 3},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := writeBuildInfo(t, 0, 10*time.Minute)
+		out, code := runWrapper(t, "-q", "--no-stdin", "--parallel-children", "--build-info-file", path, "proj", "abcdef123456", "--",
+			"sh", "-c", child(dir, "a", "b", 0), childSeparator, "sh", "-c", child(dir, "b", "a", tt.code))
+		if code != tt.wantCode {
+			t.Errorf("%v: exit code = %d, want %d; output: %s", tt.name, code, tt.wantCode, out)
+		}
+	}
+}
+
+func TestParallelChildrenAnyFail(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	started := time.Now()
+	out, code := runWrapper(t, "-q", "--no-stdin", "--parallel-children", "--parallel-exit-policy", "any-fail",
+		"--build-info-file", path, "proj", "abcdef123456", "--",
+		"sh", "-c", "exec sleep 30", childSeparator, "sh", "-c", "sleep 0.2; exit 4")
+	if code != 4 {
+		t.Errorf("exit code = %d, want 4; output: %s", code, out)
+	}
+	// the first child is signaled once the second fails, rather than running to the end
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("wrapper took %v", elapsed)
+	}
+}
+
+func TestParallelChildrenInvalid(t *testing.T) {
+	path := writeBuildInfo(t, 0, 10*time.Minute)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--parallel-children", "--", "true", childSeparator}, "command 2 is empty"},
+		{[]string{"--parallel-children", "--parallel-exit-policy", "first", "--", "true"}, "--parallel-exit-policy must be one of"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"--validate", "--build-info-file", path, "proj", "abcdef123456"}, tt.args...)
+		out, code := runWrapper(t, args...)
+		if code == 0 || !strings.Contains(out, tt.want) {
+			t.Errorf("%q: exit code = %d, output %q; want %q", tt.args, code, out, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// notifyTimeout bounds each --notify-url request.
+const notifyTimeout = 5 * time.Second
+
+// pendingNotifications tracks notifications still being sent, so exit can wait for them.
+var pendingNotifications sync.WaitGroup
+
+// signalNotification is the JSON payload posted to --notify-url.
+type signalNotification struct {
+	BuildID   string `json:"buildId"`
+	ProjectID string `json:"projectId"`
+	Step      string `json:"step,omitempty"`
+	Signal    string `json:"signal"`
+	Timestamp string `json:"timestamp"`
+}
+
+// notifySignal posts a notification that sig is being sent to the process to url in
+// the background, logging rather than returning any failure.
+func notifySignal(url string, sig string) {
+	payload := signalNotification{
+		BuildID:   buildId,
+		ProjectID: projectId,
+		Step:      stepName,
+		Signal:    sig,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	pendingNotifications.Add(1)
+	go func() {
+		defer pendingNotifications.Done()
+
+		if err := postNotification(url, payload); err != nil && !quiet {
+			WarningLogger.Printf("Unable to send notification to --notify-url: %v\n", err.Error())
+		}
+	}()
+}
+
+func postNotification(url string, payload signalNotification) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("unexpected response status %v", resp.Status))
+	}
+	return nil
+}
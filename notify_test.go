@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotifySignal(t *testing.T) {
+	oldBuildId, oldProjectId, oldStepName := buildId, projectId, stepName
+	defer func() { buildId, projectId, stepName = oldBuildId, oldProjectId, oldStepName }()
+	buildId, projectId = "build-123", "project-456"
+
+	tests := []struct {
+		name string
+		step string
+		want string
+	}{
+		{"with step", "compile", "compile"},
+		{"without step", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stepName = test.step
+
+			bodies := make(chan []byte, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies <- body
+			}))
+			defer server.Close()
+
+			notifySignal(server.URL, "SIGTERM")
+			pendingNotifications.Wait()
+
+			body := <-bodies
+			var payload map[string]interface{}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatalf("notification %q isn't valid JSON: %v", body, err)
+			}
+			if payload["buildId"] != "build-123" || payload["projectId"] != "project-456" || payload["signal"] != "SIGTERM" {
+				t.Errorf("got notification %s", body)
+			}
+			step, ok := payload["step"]
+			if test.want == "" {
+				if ok {
+					t.Errorf("notification %s has a step without --step-name", body)
+				}
+			} else if step != test.want {
+				t.Errorf("got step %v, want %v", step, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lineWriter relays the process's output to out a line at a time, prefixing each
+// line with the time it was written when timestampFormat is set, and truncating
+// lines longer than maxLength when it is non-zero. When stream is set, each line is
+// written as a JSON log entry from that stream instead.
+type lineWriter struct {
+	mu              sync.Mutex
+	out             io.Writer
+	timestampFormat string
+	maxLength       int
+	stream          string
+	buf             []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) writeLine(line []byte) error {
+	if content := len(line) - 1; w.maxLength > 0 && content > w.maxLength {
+		line = []byte(fmt.Sprintf("%s... [%d bytes truncated]\n", line[:w.maxLength], content-w.maxLength))
+	}
+
+	if w.stream != "" {
+		return w.writeJSONLine(bytes.TrimSuffix(line, []byte("\n")))
+	}
+
+	if w.timestampFormat != "" {
+		if _, err := io.WriteString(w.out, time.Now().Format(w.timestampFormat)+" "); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.out.Write(line)
+	return err
+}
+
+// writeJSONLine writes line as a JSON log entry. A line that is itself a JSON object is
+// embedded as the entry's output, with the object's own message, if any, as the message.
+func (w *lineWriter) writeJSONLine(line []byte) error {
+	severity := "INFO"
+	if w.stream == "stderr" {
+		severity = "ERROR"
+	}
+	entries := &jsonLogWriter{out: w.out, severity: severity}
+	fields := map[string]interface{}{"stream": w.stream}
+
+	var object map[string]interface{}
+	if bytes.HasPrefix(line, []byte("{")) && json.Unmarshal(line, &object) == nil {
+		fields["output"] = json.RawMessage(line)
+		message, _ := object["message"].(string)
+		return entries.writeEntry(message, fields)
+	}
+
+	return entries.writeEntry(string(line), fields)
+}
+
+// Flush writes out a trailing partial line, terminating it with a newline.
+func (w *lineWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+	return err
+}
+
+// outputActivity records when the process last wrote any output, and how much it has
+// written.
+type outputActivity struct {
+	last  int64
+	bytes int64
+	lines int64
+}
+
+// wrap returns a writer that passes writes through to out, recording them in a.
+func (a *outputActivity) wrap(out io.Writer) io.Writer {
+	return &activityWriter{out: out, activity: a}
+}
+
+// lastOutput returns when the process last wrote output, or the zero time if it hasn't.
+func (a *outputActivity) lastOutput() time.Time {
+	nanos := atomic.LoadInt64(&a.last)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// written returns how many bytes and lines the process has written.
+func (a *outputActivity) written() (int64, int64) {
+	return atomic.LoadInt64(&a.bytes), atomic.LoadInt64(&a.lines)
+}
+
+type activityWriter struct {
+	out      io.Writer
+	activity *outputActivity
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&w.activity.last, time.Now().UnixNano())
+	atomic.AddInt64(&w.activity.bytes, int64(len(p)))
+	atomic.AddInt64(&w.activity.lines, int64(bytes.Count(p, []byte("\n"))))
+	return w.out.Write(p)
+}
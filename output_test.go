@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		maxLength int
+		writes    []string
+		want      string
+	}{
+		// a layout without any time fields formats to itself
+		{"timestamped", "[ts]", 0, []string{"a\nb\n"}, "[ts] a\n[ts] b\n"},
+		{"line split across writes", "[ts]", 0, []string{"hel", "lo\nwor", "ld\n"}, "[ts] hello\n[ts] world\n"},
+		{"partial last line flushed", "[ts]", 0, []string{"a\nb"}, "[ts] a\n[ts] b\n"},
+		{"passed through", "", 0, []string{"a\n", "b"}, "a\nb\n"},
+		{"long line truncated", "", 5, []string{"abcdefgh\n"}, "abcde... [3 bytes truncated]\n"},
+		{"line at the limit kept", "", 5, []string{"abcde\n"}, "abcde\n"},
+		{"truncated and timestamped", "[ts]", 2, []string{"abc\nd\n"}, "[ts] ab... [1 bytes truncated]\n[ts] d\n"},
+		{"long partial last line", "", 2, []string{"abc"}, "ab... [1 bytes truncated]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &lineWriter{out: &out, timestampFormat: tt.format, maxLength: tt.maxLength}
+			for _, p := range tt.writes {
+				if n, err := w.Write([]byte(p)); err != nil || n != len(p) {
+					t.Fatalf("Write(%q) = %d, %v", p, n, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("wrote %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLineWriterJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		stream      string
+		maxLength   int
+		line        string
+		wantMessage string
+		wantOutput  string
+		severity    string
+	}{
+		{"text line", "stdout", 0, "hello world", "hello world", "", "INFO"},
+		{"stderr", "stderr", 0, "oops", "oops", "", "ERROR"},
+		{"JSON object embedded", "stdout", 0, `{"message":"hi","n":1}`, "hi", `{"message":"hi","n":1}`, "INFO"},
+		{"JSON object without a message", "stdout", 0, `{"n":1}`, "", `{"n":1}`, "INFO"},
+		{"JSON that isn't an object", "stdout", 0, `[1,2]`, "[1,2]", "", "INFO"},
+		{"invalid JSON", "stdout", 0, `{"n":`, `{"n":`, "", "INFO"},
+		{"truncated JSON is text", "stdout", 5, `{"n":12345}`, `{"n":... [6 bytes truncated]`, "", "INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &lineWriter{out: &out, maxLength: tt.maxLength, stream: tt.stream}
+			if _, err := w.Write([]byte(tt.line + "\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			var entry struct {
+				Severity string          `json:"severity"`
+				Message  string          `json:"message"`
+				Stream   string          `json:"stream"`
+				Output   json.RawMessage `json:"output"`
+			}
+			if err := json.Unmarshal(out.Bytes(), &entry); err != nil || strings.Count(out.String(), "\n") != 1 {
+				t.Fatalf("wrote %q, want a single JSON log entry: %v", out.String(), err)
+			}
+			if entry.Message != tt.wantMessage || string(entry.Output) != tt.wantOutput || entry.Stream != tt.stream || entry.Severity != tt.severity {
+				t.Errorf("wrote %q; want message %q, output %q, stream %v and severity %v", out.String(), tt.wantMessage, tt.wantOutput, tt.stream, tt.severity)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// childSeparator separates the command groups run with --parallel-children.
+const childSeparator = ":::"
+
+// parallelRunner runs several commands at once as children for --parallel-children,
+// behaving to runCommand as a single process: it is signaled by signaling every child,
+// and has exited once they all have.
+type parallelRunner struct {
+	children []commandRunner
+	names    []string
+}
+
+// splitCommandGroups splits args into the commands separated by childSeparator.
+func splitCommandGroups(args []string) ([][]string, error) {
+	var groups [][]string
+	group := []string{}
+	for _, arg := range args {
+		if arg != childSeparator {
+			group = append(group, arg)
+			continue
+		}
+		groups = append(groups, group)
+		group = []string{}
+	}
+	groups = append(groups, group)
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			return nil, errors.New(fmt.Sprintf("--parallel-children: command %d is empty; separate commands with %v", i+1, childSeparator))
+		}
+	}
+	return groups, nil
+}
+
+// newParallelRunner prepares a child process for each of the commands in cmdName and
+// cmdArgs separated by childSeparator, all writing to stdout and stderr.
+func newParallelRunner(ctx context.Context, cmdName string, cmdArgs []string, stdout io.Writer, stderr io.Writer) (commandRunner, error) {
+	groups, err := splitCommandGroups(append([]string{cmdName}, cmdArgs...))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parallelRunner{}
+	for _, group := range groups {
+		name, args := group[0], group[1:]
+		if useShell {
+			name, args = shellPath, []string{"-c", strings.Join(group, " ")}
+		}
+
+		child, err := newExecRunner(ctx, name, args, stdout, stderr)
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+		p.names = append(p.names, strings.Join(redactArgs(group), " "))
+	}
+	return p, nil
+}
+
+// Start starts every child. If one fails to start, those already started are killed.
+func (p *parallelRunner) Start() error {
+	for i, child := range p.children {
+		if err := child.Start(); err != nil {
+			for _, started := range p.children[:i] {
+				_ = started.Signal(syscall.SIGKILL)
+				_ = started.Wait()
+			}
+			return errors.New(fmt.Sprintf("error starting child %d (%v): %v", i+1, p.names[i], err.Error()))
+		}
+	}
+	return nil
+}
+
+// childResult is how a child of a parallelRunner exited.
+type childResult struct {
+	index int
+	err   error
+}
+
+// Wait waits for every child to exit, and returns the result of the first to fail, if
+// any did. With --parallel-exit-policy=any-fail, the rest are sent --timeout-signal as
+// soon as one fails.
+func (p *parallelRunner) Wait() error {
+	results := make(chan childResult, len(p.children))
+	for i, child := range p.children {
+		go func(i int, child commandRunner) {
+			results <- childResult{index: i, err: child.Wait()}
+		}(i, child)
+	}
+
+	var failed error
+	for range p.children {
+		result := <-results
+		if result.err == nil {
+			if verbose {
+				InfoLogger.Printf("Child %d (%v) exited successfully\n", result.index+1, p.names[result.index])
+			}
+			continue
+		}
+
+		if !quiet {
+			WarningLogger.Printf("Child %d (%v) failed: %v\n", result.index+1, p.names[result.index], result.err.Error())
+		}
+		if failed != nil {
+			continue
+		}
+		failed = result.err
+		if parallelExitPolicy == "any-fail" {
+			if !quiet {
+				WarningLogger.Printf("Sending %v signal to the remaining children under --parallel-exit-policy=any-fail\n", timeoutSigStr)
+			}
+			_ = p.Signal(validSignals[timeoutSigStr])
+		}
+	}
+
+	return failed
+}
+
+// Signal sends sig to every child still running. It reports the process as done only
+// once every child is.
+func (p *parallelRunner) Signal(sig os.Signal) error {
+	var failed error
+	running := 0
+	for _, child := range p.children {
+		err := child.Signal(sig)
+		if isProcessDone(err) {
+			continue
+		}
+		running++
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+
+	if running == 0 {
+		return os.ErrProcessDone
+	}
+	return failed
+}
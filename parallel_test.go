@@ -0,0 +1,126 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSplitCommandGroups(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    [][]string
+		wantErr bool
+	}{
+		{[]string{"make", "test"}, [][]string{{"make", "test"}}, false},
+		{[]string{"server", "--port", "80", ":::", "harness"}, [][]string{{"server", "--port", "80"}, {"harness"}}, false},
+		{[]string{"a", ":::", "b", ":::", "c", "-v"}, [][]string{{"a"}, {"b"}, {"c", "-v"}}, false},
+		{[]string{"a", ":::"}, nil, true},
+		{[]string{":::", "b"}, nil, true},
+		{[]string{"a", ":::", ":::", "b"}, nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := splitCommandGroups(test.args)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.args, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestRunCommandParallelChildrenSignaled(t *testing.T) {
+	children := []*fakeRunner{newFakeRunner(syscall.SIGTERM, nil), newFakeRunner(syscall.SIGTERM, nil)}
+	useFakeRunner(t, children[0])
+	newCommandRunner = func(context.Context, string, []string, io.Writer, io.Writer) (commandRunner, error) {
+		return &parallelRunner{children: []commandRunner{children[0], children[1]}, names: []string{"server", "harness"}}, nil
+	}
+
+	if err := runCommand(context.Background(), "server", []string{childSeparator, "harness"}, 10*time.Millisecond, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	for i, child := range children {
+		if sig := <-child.signals; sig != syscall.SIGTERM {
+			t.Errorf("child %d was sent %v, want SIGTERM", i+1, sig)
+		}
+	}
+}
+
+func TestParallelRunnerExitPolicy(t *testing.T) {
+	savedPolicy, savedQuiet, savedTimeoutSig := parallelExitPolicy, quiet, timeoutSigStr
+	defer func() { parallelExitPolicy, quiet, timeoutSigStr = savedPolicy, savedQuiet, savedTimeoutSig }()
+	quiet, timeoutSigStr = true, "SIGTERM"
+	exitErr := errors.New("exit status 3")
+
+	tests := []struct {
+		policy       string
+		failing      error
+		wantErr      error
+		wantSignaled bool
+	}{
+		{"all-succeed", nil, nil, false},
+		{"all-succeed", exitErr, exitErr, false},
+		{"any-fail", nil, nil, false},
+		{"any-fail", exitErr, exitErr, true},
+	}
+
+	for _, test := range tests {
+		parallelExitPolicy = test.policy
+		// the first child runs until it is signaled, or exits cleanly on its own
+		running := newFakeRunner(syscall.SIGTERM, nil)
+		if !test.wantSignaled {
+			running.exited <- nil
+		}
+		failing := newFakeRunner(nil, nil)
+		failing.exited <- test.failing
+
+		p := &parallelRunner{children: []commandRunner{running, failing}, names: []string{"server", "harness"}}
+		if err := p.Wait(); err != test.wantErr {
+			t.Errorf("%v with %v: Wait returned %v, want %v", test.policy, test.failing, err, test.wantErr)
+		}
+		if signaled := len(running.signals) > 0; signaled != test.wantSignaled {
+			t.Errorf("%v with %v: running child signaled = %v, want %v", test.policy, test.failing, signaled, test.wantSignaled)
+		}
+	}
+}
+
+// doneRunner is a process that has already exited.
+type doneRunner struct{}
+
+func (doneRunner) Start() error           { return nil }
+func (doneRunner) Wait() error            { return nil }
+func (doneRunner) Signal(os.Signal) error { return os.ErrProcessDone }
+
+func TestParallelRunnerSignalDone(t *testing.T) {
+	p := &parallelRunner{children: []commandRunner{&doneRunner{}, newFakeRunner(nil, nil)}, names: []string{"a", "b"}}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Errorf("signaling with a child still running returned %v", err)
+	}
+
+	p = &parallelRunner{children: []commandRunner{&doneRunner{}, &doneRunner{}}, names: []string{"a", "b"}}
+	if err := p.Signal(syscall.SIGTERM); !isProcessDone(err) {
+		t.Errorf("signaling with every child exited returned %v, want it reported as done", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// pprofServer serves the wrapper's own profiles when --pprof-addr is set.
+var pprofServer *http.Server
+
+// startPprofServer serves net/http/pprof on addr in the background.
+func startPprofServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.New(fmt.Sprintf("error listening on --pprof-addr: %v", err.Error()))
+	}
+
+	// /debug/pprof/cmdline is left out, since it would serve the arguments without --redact-args
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	pprofServer = &http.Server{Handler: mux}
+	go func() {
+		if err := pprofServer.Serve(listener); err != nil && err != http.ErrServerClosed && !quiet {
+			WarningLogger.Printf("pprof server stopped: %v\n", err.Error())
+		}
+	}()
+
+	if verbose {
+		InfoLogger.Printf("Serving pprof on http://%v/debug/pprof/\n", listener.Addr())
+	}
+
+	return nil
+}
+
+// stopPprofServer shuts down the pprof server, if it was started.
+func stopPprofServer() {
+	if pprofServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = pprofServer.Shutdown(ctx)
+}
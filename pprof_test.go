@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprofServer(t *testing.T) {
+	// find a free port, then hand it to the server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on loopback: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	if err := startPprofServer(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stopPprofServer()
+		pprofServer = nil
+	}()
+
+	resp, err := http.Get("http://" + addr + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("pprof index returned %v: %.100q", resp.Status, body)
+	}
+
+	cmdline, err := http.Get("http://" + addr + "/debug/pprof/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdline.Body.Close()
+	if cmdline.StatusCode != http.StatusNotFound {
+		t.Errorf("/debug/pprof/cmdline returned %v, want %v", cmdline.Status, http.StatusNotFound)
+	}
+
+	if err := startPprofServer(addr); err == nil {
+		t.Error("starting a second server on the same address succeeded")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// commandRunner runs the wrapped command. Outside of tests it is always an *execRunner.
+type commandRunner interface {
+	// Start starts the command without waiting for it to exit.
+	Start() error
+	// Wait waits for the command to exit and returns the result of running it.
+	Wait() error
+	// Signal sends sig to the command.
+	Signal(sig os.Signal) error
+}
+
+// newCommandRunner creates the runner for the wrapped command; tests replace it to run
+// runCommand against a fake process.
+var newCommandRunner = newExecRunner
+
+// execRunner runs the wrapped command as a child process.
+type execRunner struct {
+	cmd *exec.Cmd
+
+	// mu serializes signaling the process against it being reaped, after which its PID,
+	// and its process group's, may be reused
+	mu     sync.Mutex
+	exited bool
+	// pidfd refers to the process on Linux, or is -1
+	pidfd int
+}
+
+// newExecRunner prepares the command to run as a child process, writing its output to
+// stdout and stderr. If ctx is cancelled before it exits, it is sent --kill-signal.
+func newExecRunner(ctx context.Context, cmdName string, cmdArgs []string, stdout io.Writer, stderr io.Writer) (commandRunner, error) {
+	cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+	r := &execRunner{cmd: cmd, pidfd: -1}
+	cmd.Cancel = func() error {
+		return r.Signal(validSignals[killSigStr])
+	}
+	cmd.Dir = commandDir
+	if len(envOverrides) > 0 {
+		// exec keeps the last value of a repeated key, so these take precedence
+		cmd.Env = append(os.Environ(), envOverrides...)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if !noStdin && !holdStdinOpen {
+		// the process gets the wrapper's own stdin file directly, so nothing needs copying
+		// or closing on its behalf
+		cmd.Stdin = os.Stdin
+	}
+
+	if holdStdinOpen {
+		// nothing is ever written, but keeping the pipe open means the process never sees
+		// EOF; the pipe is closed once the process has exited
+		if _, err := cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+
+	if newSession {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	} else if cmd.Stdin == os.Stdin && isTerminal(os.Stdin.Fd()) {
+		// a process outside the terminal's foreground process group is stopped with SIGTTIN
+		// when it reads from it, so leave it in ours
+		if verbose {
+			InfoLogger.Println("Stdin is a terminal; running the process in the wrapper's process group")
+		}
+	} else if !noCleanupChildren || processGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	// when output goes through the wrapper, Wait waits for the process's output to be
+	// copied before returning; bound that wait, since children that outlive the process
+	// can hold its output open indefinitely. Once WaitDelay passes, exec kills the process,
+	// which --signal-dry-run mustn't do.
+	if !signalDryRun {
+		cmd.WaitDelay = childExitGraceDur
+	}
+
+	return r, nil
+}
+
+func (r *execRunner) Start() error {
+	if err := r.cmd.Start(); err != nil {
+		return err
+	}
+
+	// opened before anything waits on the process, so it can't refer to anything else
+	if fd, err := openPidfd(r.cmd.Process.Pid); err == nil {
+		r.mu.Lock()
+		r.pidfd = fd
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *execRunner) Wait() error {
+	// where the process can be waited for without reaping it, Signal is stopped before
+	// it is reaped; elsewhere, only once it has been
+	if waitExited(r.cmd.Process.Pid) {
+		r.markExited()
+	}
+	err := r.cmd.Wait()
+	r.markExited()
+	if err != nil && r.cmd.ProcessState != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		// exec reports a process that exits cleanly after ctx is cancelled with ctx's error;
+		// report how the process itself exited instead
+		if r.cmd.ProcessState.Success() {
+			return nil
+		}
+		return &exec.ExitError{ProcessState: r.cmd.ProcessState}
+	}
+	return err
+}
+
+// markExited stops the process from being signaled any further.
+func (r *execRunner) markExited() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.exited {
+		return
+	}
+	r.exited = true
+	if r.pidfd >= 0 {
+		_ = syscall.Close(r.pidfd)
+		r.pidfd = -1
+	}
+}
+
+// Signal sends sig to the process. When the process was started in its own process group,
+// the whole group is signaled so that its children receive it too. With --signal-dry-run,
+// the signal is only logged.
+func (r *execRunner) Signal(sig os.Signal) error {
+	if signalDryRun {
+		if !quiet {
+			WarningLogger.Printf("Dry run: would send %v to PID %d\n", signalName(sig), r.cmd.Process.Pid)
+		}
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exited {
+		return os.ErrProcessDone
+	}
+
+	sysSig, ok := sig.(syscall.Signal)
+	if ok && (newSession || processGroup) && r.inOwnProcessGroup() {
+		// on platforms where Wait can't hold off reaping, the process may have been reaped
+		// since exited was checked; os.Process knows, so check with it first
+		if err := r.cmd.Process.Signal(syscall.Signal(0)); err != nil {
+			return err
+		}
+		return syscall.Kill(-r.cmd.Process.Pid, sysSig)
+	}
+
+	if ok && r.pidfd >= 0 {
+		return pidfdSignal(r.pidfd, sysSig)
+	}
+	return r.cmd.Process.Signal(sig)
+}
+
+// inOwnProcessGroup reports whether the process was started in a process group of its own,
+// which can be signaled as a whole.
+func (r *execRunner) inOwnProcessGroup() bool {
+	attr := r.cmd.SysProcAttr
+	return attr != nil && (attr.Setpgid || attr.Setsid)
+}
+
+// finish logs and cleans up after the process has exited.
+func (r *execRunner) finish() {
+	if logExitDetails && r.cmd.ProcessState != nil {
+		logChildExitDetails(r.cmd.ProcessState)
+	}
+
+	if !noCleanupChildren && r.inOwnProcessGroup() {
+		r.killProcessGroup()
+	}
+}
+
+// killProcessGroup sends SIGKILL to anything left in the process's group after it exits,
+// so orphaned processes aren't carried into later build steps.
+func (r *execRunner) killProcessGroup() {
+	if r.cmd.Process == nil {
+		return
+	}
+
+	if signalDryRun {
+		if !quiet {
+			WarningLogger.Printf("Dry run: would send SIGKILL to what remains of process group %d\n", r.cmd.Process.Pid)
+		}
+		return
+	}
+
+	err := syscall.Kill(-r.cmd.Process.Pid, syscall.SIGKILL)
+	if err == nil && !quiet {
+		WarningLogger.Printf("Killed processes remaining in process group %d\n", r.cmd.Process.Pid)
+	} else if err != nil && err != syscall.ESRCH && !quiet {
+		WarningLogger.Printf("Unable to clean up process group %d: %v\n", r.cmd.Process.Pid, err.Error())
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "syscall"
+
+// openPidfd is only supported on Linux.
+func openPidfd(pid int) (int, error) {
+	return -1, syscall.ENOSYS
+}
+
+// pidfdSignal is only supported on Linux.
+func pidfdSignal(pidfd int, sig syscall.Signal) error {
+	return syscall.ENOSYS
+}
+
+// waitExited can't wait for a child without reaping it here, so it leaves waiting to Wait.
+func waitExited(pid int) bool {
+	return false
+}
@@ -0,0 +1,589 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeRunner stands in for the wrapped process, recording the signals it is sent and
+// exiting with exitErr once it is sent exitOn. Sending it failOn fails.
+type fakeRunner struct {
+	signals chan os.Signal
+	exited  chan error
+	exitOn  os.Signal
+	exitErr error
+	failOn  os.Signal
+}
+
+func newFakeRunner(exitOn os.Signal, exitErr error) *fakeRunner {
+	return &fakeRunner{signals: make(chan os.Signal, 10), exited: make(chan error, 1), exitOn: exitOn, exitErr: exitErr}
+}
+
+func (f *fakeRunner) Start() error {
+	return nil
+}
+
+func (f *fakeRunner) Wait() error {
+	return <-f.exited
+}
+
+func (f *fakeRunner) Signal(sig os.Signal) error {
+	f.signals <- sig
+	if sig == f.failOn {
+		return syscall.EPERM
+	}
+	if sig == f.exitOn {
+		f.exited <- f.exitErr
+	}
+	return nil
+}
+
+// useFakeRunner makes runCommand run f instead of a process, with default signal flags.
+func useFakeRunner(t *testing.T, f *fakeRunner) {
+	savedRunner, savedQuiet := newCommandRunner, quiet
+	savedSignal, savedTimeoutSig, savedKillSig := signalStr, timeoutSigStr, killSigStr
+	t.Cleanup(func() {
+		newCommandRunner, quiet = savedRunner, savedQuiet
+		signalStr, timeoutSigStr, killSigStr = savedSignal, savedTimeoutSig, savedKillSig
+		processTimedOut = false
+	})
+
+	newCommandRunner = func(context.Context, string, []string, io.Writer, io.Writer) (commandRunner, error) {
+		return f, nil
+	}
+	quiet = true
+	signalStr, timeoutSigStr, killSigStr = "SIGTERM", "SIGTERM", "SIGKILL"
+	processTimedOut = false
+}
+
+// captureWarnings turns off --quiet and returns the buffer WarningLogger writes to.
+func captureWarnings(t *testing.T) *bytes.Buffer {
+	savedLogger := WarningLogger
+	t.Cleanup(func() { WarningLogger = savedLogger })
+
+	var buf bytes.Buffer
+	WarningLogger = log.New(&buf, "", 0)
+	quiet = false
+	return &buf
+}
+
+func TestRunCommandCleanExit(t *testing.T) {
+	f := newFakeRunner(nil, nil)
+	useFakeRunner(t, f)
+	f.exited <- nil
+
+	if err := runCommand(context.Background(), "fake", nil, noSignalTimeout, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if processTimedOut {
+		t.Error("process was marked as timed out")
+	}
+	if len(f.signals) > 0 {
+		t.Errorf("process was sent %v", <-f.signals)
+	}
+}
+
+func TestRunCommandTimeoutSignals(t *testing.T) {
+	exitErr := errors.New("terminated")
+	f := newFakeRunner(syscall.SIGTERM, exitErr)
+	useFakeRunner(t, f)
+
+	if err := runCommand(context.Background(), "fake", nil, 10*time.Millisecond, make(chan os.Signal, 1)); err != exitErr {
+		t.Errorf("runCommand returned %v, want %v", err, exitErr)
+	}
+	if !processTimedOut {
+		t.Error("process wasn't marked as timed out")
+	}
+	if sig := <-f.signals; sig != syscall.SIGTERM {
+		t.Errorf("process was sent %v, want SIGTERM", sig)
+	}
+}
+
+func TestRunCommandForwardsSignals(t *testing.T) {
+	exitErr := errors.New("interrupted")
+	f := newFakeRunner(syscall.SIGINT, exitErr)
+	useFakeRunner(t, f)
+
+	sigChan := make(chan os.Signal, 1)
+	sigChan <- syscall.SIGINT
+	if err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan); err != exitErr {
+		t.Errorf("runCommand returned %v, want %v", err, exitErr)
+	}
+	if processTimedOut {
+		t.Error("process was marked as timed out")
+	}
+	if sig := <-f.signals; sig != syscall.SIGINT {
+		t.Errorf("process was sent %v, want SIGINT", sig)
+	}
+}
+
+func TestRunCommandTimeoutSignalOverridesSignal(t *testing.T) {
+	f := newFakeRunner(syscall.SIGUSR1, nil)
+	useFakeRunner(t, f)
+	timeoutSigStr = "SIGUSR1"
+
+	if err := runCommand(context.Background(), "fake", nil, 10*time.Millisecond, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if sig := <-f.signals; sig != syscall.SIGUSR1 {
+		t.Errorf("process was sent %v for the timeout, want --timeout-signal SIGUSR1", sig)
+	}
+}
+
+func TestRunCommandPreSignalHook(t *testing.T) {
+	savedHook, savedHookTimeout := preSignalHook, preSignalHookTimeoutDur
+	defer func() { preSignalHook, preSignalHookTimeoutDur = savedHook, savedHookTimeout }()
+	marker := filepath.Join(t.TempDir(), "ran")
+
+	tests := []struct {
+		name    string
+		hook    string
+		timeout time.Duration
+	}{
+		{"finishes", "touch " + marker, 5 * time.Second},
+		{"times out", "exec sleep 5", 50 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeRunner(syscall.SIGTERM, nil)
+			useFakeRunner(t, f)
+			preSignalHook, preSignalHookTimeoutDur = test.hook, test.timeout
+
+			start := time.Now()
+			if err := runCommand(context.Background(), "fake", nil, 10*time.Millisecond, make(chan os.Signal, 1)); err != nil {
+				t.Errorf("runCommand returned %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("process was signaled after %v, not once the hook finished or timed out", elapsed)
+			}
+			if sig := <-f.signals; sig != syscall.SIGTERM {
+				t.Errorf("process was sent %v, want SIGTERM", sig)
+			}
+		})
+	}
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("pre-signal hook didn't run: %v", err)
+	}
+}
+
+func TestRunCommandPreSignalHookDoesNotBlock(t *testing.T) {
+	savedHook, savedHookTimeout := preSignalHook, preSignalHookTimeoutDur
+	defer func() { preSignalHook, preSignalHookTimeoutDur = savedHook, savedHookTimeout }()
+	preSignalHook, preSignalHookTimeoutDur = "exec sleep 5", 10*time.Second
+
+	exitErr := errors.New("interrupted")
+	f := newFakeRunner(syscall.SIGINT, exitErr)
+	useFakeRunner(t, f)
+
+	// forwarded while the hook is still running
+	sigChan := make(chan os.Signal, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sigChan <- syscall.SIGINT
+	}()
+
+	start := time.Now()
+	if err := runCommand(context.Background(), "fake", nil, 10*time.Millisecond, sigChan); err != exitErr {
+		t.Errorf("runCommand returned %v, want %v", err, exitErr)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("runCommand took %v; the hook blocked it", elapsed)
+	}
+	if sig := <-f.signals; sig != syscall.SIGINT {
+		t.Errorf("process was sent %v, want the forwarded SIGINT", sig)
+	}
+	if len(f.signals) > 0 {
+		t.Errorf("process was also sent %v", <-f.signals)
+	}
+}
+
+func TestRunCommandWarnBefore(t *testing.T) {
+	f := newFakeRunner(syscall.SIGTERM, nil)
+	useFakeRunner(t, f)
+	warnings := captureWarnings(t)
+	savedWarnBefore := warnBeforeDur
+	defer func() { warnBeforeDur = savedWarnBefore }()
+	warnBeforeDur = 50 * time.Millisecond
+
+	if err := runCommand(context.Background(), "fake", nil, 100*time.Millisecond, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if n := strings.Count(warnings.String(), "Process will be sent SIGTERM"); n != 1 {
+		t.Errorf("got %d --warn-before warnings in %q, want 1", n, warnings.String())
+	}
+}
+
+func TestExecRunnerSignalAfterExit(t *testing.T) {
+	savedNoStdin, savedGroup := noStdin, processGroup
+	defer func() { noStdin, processGroup = savedNoStdin, savedGroup }()
+	noStdin, processGroup = true, true
+
+	runner, err := newExecRunner(context.Background(), "true", nil, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the PID may already belong to someone else, so its group mustn't be signaled
+	if err := runner.Signal(syscall.SIGTERM); !isProcessDone(err) {
+		t.Errorf("signaling an exited process returned %v, want it reported as done", err)
+	}
+}
+
+func TestExecRunnerDryRunCancel(t *testing.T) {
+	savedNoStdin, savedDryRun, savedGrace, savedQuiet := noStdin, signalDryRun, childExitGraceDur, quiet
+	defer func() {
+		noStdin, signalDryRun, childExitGraceDur, quiet = savedNoStdin, savedDryRun, savedGrace, savedQuiet
+	}()
+	noStdin, signalDryRun, childExitGraceDur, quiet = true, true, 10*time.Millisecond, true
+
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"sleep 0.2", 0},
+		{"sleep 0.2; exit 3", 3},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		runner, err := newExecRunner(ctx, "sh", []string{"-c", test.script}, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runner.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// with --signal-dry-run, cancelling only logs, and the process runs to completion
+		cancel()
+
+		err = runner.Wait()
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			t.Errorf("%q: Wait returned %v", test.script, err)
+			continue
+		}
+		if code != test.want {
+			t.Errorf("%q: got exit code %d, want %d", test.script, code, test.want)
+		}
+	}
+}
+
+func TestRunCommandFallbackSignal(t *testing.T) {
+	f := newFakeRunner(syscall.SIGINT, nil)
+	f.failOn = syscall.SIGTERM
+	useFakeRunner(t, f)
+	savedFallback := fallbackSigStr
+	defer func() { fallbackSigStr = savedFallback }()
+	fallbackSigStr = "SIGINT"
+
+	if err := runCommand(context.Background(), "fake", nil, 10*time.Millisecond, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	// the timeout signal is retried once before falling back
+	for _, want := range []os.Signal{syscall.SIGTERM, syscall.SIGTERM, syscall.SIGINT} {
+		if sig := <-f.signals; sig != want {
+			t.Errorf("process was sent %v, want %v", sig, want)
+		}
+	}
+}
+
+func TestRunCommandSignalOnFile(t *testing.T) {
+	f := newFakeRunner(syscall.SIGTERM, nil)
+	useFakeRunner(t, f)
+	savedFile, savedExisting := signalOnFile, signalOnFileExisting
+	defer func() { signalOnFile, signalOnFileExisting = savedFile, savedExisting }()
+	sentinel := filepath.Join(t.TempDir(), "stop")
+	signalOnFile, signalOnFileExisting = sentinel, "ignore"
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		_ = ioutil.WriteFile(sentinel, nil, 0644)
+	})
+	if err := runCommand(context.Background(), "fake", nil, noSignalTimeout, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if sig := <-f.signals; sig != syscall.SIGTERM {
+		t.Errorf("process was sent %v, want SIGTERM", sig)
+	}
+}
+
+func TestRunCommandUpgradeFirstSignal(t *testing.T) {
+	f := newFakeRunner(syscall.SIGTERM, nil)
+	useFakeRunner(t, f)
+	savedUpgrade := upgradeFirstSignal
+	defer func() { upgradeFirstSignal = savedUpgrade }()
+	upgradeFirstSignal = true
+
+	sigChan := make(chan os.Signal, 1)
+	sigChan <- syscall.SIGINT
+	if err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if sig := <-f.signals; sig != syscall.SIGTERM {
+		t.Errorf("process was sent %v in place of SIGINT, want --signal SIGTERM", sig)
+	}
+}
+
+func TestRunCommandRestartOnSignal(t *testing.T) {
+	first := newFakeRunner(syscall.SIGTERM, errors.New("terminated"))
+	second := newFakeRunner(nil, nil)
+	second.exited <- nil
+	sigChan := make(chan os.Signal, 1)
+	started := restartRunners(t, sigChan, first, second)
+
+	if err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan); err != nil {
+		t.Errorf("runCommand returned %v, want the restarted process's result", err)
+	}
+	if *started != 2 {
+		t.Errorf("process was started %d times, want 2", *started)
+	}
+	if sig := <-first.signals; sig != syscall.SIGTERM {
+		t.Errorf("process was sent %v to restart it, want --signal SIGTERM", sig)
+	}
+	if len(second.signals) > 0 {
+		t.Errorf("restarted process was sent %v", <-second.signals)
+	}
+}
+
+func TestRunCommandForwardMinInterval(t *testing.T) {
+	f := newFakeRunner(syscall.SIGTERM, nil)
+	useFakeRunner(t, f)
+	savedInterval := forwardMinIntervalDur
+	defer func() { forwardMinIntervalDur = savedInterval }()
+	forwardMinIntervalDur = 100 * time.Millisecond
+
+	sigChan := make(chan os.Signal, 3)
+	sigChan <- syscall.SIGUSR1
+	sigChan <- syscall.SIGUSR2
+	sigChan <- syscall.SIGTERM
+	if err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	// SIGUSR2 arrived too soon after SIGUSR1 and was superseded by SIGTERM
+	for _, want := range []os.Signal{syscall.SIGUSR1, syscall.SIGTERM} {
+		if sig := <-f.signals; sig != want {
+			t.Errorf("process was sent %v, want %v", sig, want)
+		}
+	}
+	if len(f.signals) > 0 {
+		t.Errorf("process was also sent %v", <-f.signals)
+	}
+}
+
+func TestRunCommandTimeoutSignalSentOnce(t *testing.T) {
+	f := newFakeRunner(nil, nil)
+	useFakeRunner(t, f)
+	savedPreempt := preemptAware
+	defer func() { preemptAware = savedPreempt }()
+	preemptAware = true
+	timeoutSigStr = "SIGUSR1"
+
+	sigChan := make(chan os.Signal, 1)
+	sigChan <- syscall.SIGTERM
+	time.AfterFunc(200*time.Millisecond, func() { f.exited <- nil })
+	if err := runCommand(context.Background(), "fake", nil, 50*time.Millisecond, sigChan); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if !processTimedOut {
+		t.Error("process wasn't marked as timed out")
+	}
+	if sig := <-f.signals; sig != syscall.SIGUSR1 {
+		t.Errorf("process was sent %v, want SIGUSR1", sig)
+	}
+	if len(f.signals) > 0 {
+		t.Errorf("process was sent %v again once the timeout was reached", <-f.signals)
+	}
+}
+
+func TestRunCommandPreemptAware(t *testing.T) {
+	f := newFakeRunner(syscall.SIGUSR1, nil)
+	useFakeRunner(t, f)
+	savedPreempt := preemptAware
+	defer func() { preemptAware = savedPreempt }()
+	preemptAware = true
+	timeoutSigStr = "SIGUSR1"
+
+	sigChan := make(chan os.Signal, 1)
+	sigChan <- syscall.SIGTERM
+	if err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if sig := <-f.signals; sig != syscall.SIGUSR1 {
+		t.Errorf("process was sent %v on preemption, want the timeout signal SIGUSR1", sig)
+	}
+}
+
+// restartRunners makes runCommand run each of runners in turn, restarting on SIGHUP,
+// and returns how many have been started. Each but the last is asked to restart once
+// it has started.
+func restartRunners(t *testing.T, sigChan chan os.Signal, runners ...*fakeRunner) *int {
+	useFakeRunner(t, runners[0])
+	savedRestart := restartSigStr
+	t.Cleanup(func() { restartSigStr = savedRestart })
+	restartSigStr = "SIGHUP"
+
+	started := 0
+	newCommandRunner = func(context.Context, string, []string, io.Writer, io.Writer) (commandRunner, error) {
+		f := runners[started]
+		started++
+		if started < len(runners) {
+			sigChan <- syscall.SIGHUP
+		}
+		return f, nil
+	}
+	return &started
+}
+
+func TestRunCommandBuildFetchedOnceAcrossRestarts(t *testing.T) {
+	for _, refresh := range []bool{false, true} {
+		var runners []*fakeRunner
+		for i := 0; i < 3; i++ {
+			runners = append(runners, newFakeRunner(syscall.SIGTERM, errors.New("terminated")))
+		}
+		last := newFakeRunner(nil, nil)
+		last.exited <- nil
+		sigChan := make(chan os.Signal, 1)
+		started := restartRunners(t, sigChan, append(runners, last)...)
+
+		savedRefresh, savedRefreshTimeout := refreshOnRestart, refreshTimeout
+		refreshOnRestart = refresh
+		fetched := 0
+		refreshTimeout = func(context.Context) (time.Duration, error) {
+			fetched++
+			return time.Hour, nil
+		}
+
+		err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan)
+		refreshOnRestart, refreshTimeout = savedRefresh, savedRefreshTimeout
+
+		if err != nil {
+			t.Errorf("refresh %v: runCommand returned %v", refresh, err)
+		}
+		if *started != 4 {
+			t.Errorf("refresh %v: process was started %d times, want 4", refresh, *started)
+		}
+		want := 0
+		if refresh {
+			want = 3
+		}
+		if fetched != want {
+			t.Errorf("refresh %v: build was fetched %d times across 3 restarts, want %d", refresh, fetched, want)
+		}
+	}
+}
+
+func TestRunCommandRefreshOnRestartMovesSignalTime(t *testing.T) {
+	first := newFakeRunner(syscall.SIGTERM, errors.New("terminated"))
+	second := newFakeRunner(syscall.SIGTERM, nil)
+	sigChan := make(chan os.Signal, 1)
+	restartRunners(t, sigChan, first, second)
+	savedRefresh, savedRefreshTimeout := refreshOnRestart, refreshTimeout
+	defer func() { refreshOnRestart, refreshTimeout = savedRefresh, savedRefreshTimeout }()
+	refreshOnRestart = true
+	refreshTimeout = func(context.Context) (time.Duration, error) {
+		return 10 * time.Millisecond, nil
+	}
+
+	if err := runCommand(context.Background(), "fake", nil, time.Hour, sigChan); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if !processTimedOut {
+		t.Error("restarted process wasn't signaled at the refreshed signal time")
+	}
+}
+
+func TestRunCommandEscalationStopsWhenProcessExits(t *testing.T) {
+	f := newFakeRunner(syscall.SIGUSR1, nil)
+	useFakeRunner(t, f)
+	savedStages, savedDur, savedPercent, savedKillAfter := escalationStages, timeoutDur, timeoutPercent, killAfterDur
+	defer func() {
+		escalationStages, timeoutDur, timeoutPercent, killAfterDur = savedStages, savedDur, savedPercent, savedKillAfter
+	}()
+	timeoutDur, timeoutPercent, killAfterDur = 0, 0, 50*time.Millisecond
+	escalationStages = []escalationStage{
+		{signal: "SIGUSR1", lead: 80 * time.Millisecond},
+		{signal: "SIGUSR2", lead: 40 * time.Millisecond},
+	}
+
+	if err := runCommand(context.Background(), "fake", nil, 100*time.Millisecond, make(chan os.Signal, 1)); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	// give any stage, timeout or kill that was still queued the chance to fire
+	time.Sleep(200 * time.Millisecond)
+	if sig := <-f.signals; sig != syscall.SIGUSR1 {
+		t.Errorf("process was sent %v, want the first stage's SIGUSR1", sig)
+	}
+	if len(f.signals) > 0 {
+		t.Errorf("process was sent %v after it exited", <-f.signals)
+	}
+	if processTimedOut {
+		t.Error("process that exited during escalation was marked as timed out")
+	}
+}
+
+func TestRunCommandNoRestartNearTimeout(t *testing.T) {
+	savedCutoff := restartCutoffDur
+	defer func() { restartCutoffDur = savedCutoff }()
+	restartCutoffDur = 150 * time.Millisecond
+
+	// asked to restart inside the cutoff: shut down for the timeout instead
+	f := newFakeRunner(syscall.SIGUSR1, nil)
+	sigChan := make(chan os.Signal, 1)
+	started := restartRunners(t, sigChan, f, newFakeRunner(nil, nil))
+	timeoutSigStr = "SIGUSR1"
+	if err := runCommand(context.Background(), "fake", nil, 100*time.Millisecond, sigChan); err != nil {
+		t.Errorf("runCommand returned %v", err)
+	}
+	if sig := <-f.signals; sig != syscall.SIGUSR1 {
+		t.Errorf("process was sent %v, want the timeout signal SIGUSR1", sig)
+	}
+	if *started != 1 || !processTimedOut {
+		t.Errorf("process was started %d times and timed out %v; want it stopped for the timeout, not restarted", *started, processTimedOut)
+	}
+
+	// asked to restart before the cutoff, but only exits inside it
+	exitErr := errors.New("terminated")
+	f = newFakeRunner(nil, nil)
+	started = restartRunners(t, sigChan, f, newFakeRunner(nil, nil))
+	time.AfterFunc(100*time.Millisecond, func() { f.exited <- exitErr })
+	if err := runCommand(context.Background(), "fake", nil, 200*time.Millisecond, sigChan); err != exitErr {
+		t.Errorf("runCommand returned %v, want %v", err, exitErr)
+	}
+	if *started != 1 || !processTimedOut {
+		t.Errorf("process was started %d times and timed out %v; want it left stopped", *started, processTimedOut)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 Google LLC, Paul Durivage <durivage@google.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+// ignoredByDefault lists the signals whose default disposition on the BSDs and macOS is to
+// be ignored, so sending one has no effect unless the process handles it. Unlike on Linux,
+// where it terminates the process, SIGIO is discarded.
+var ignoredByDefault = map[string]bool{
+	"SIGCHLD":  true,
+	"SIGCONT":  true,
+	"SIGIO":    true,
+	"SIGURG":   true,
+	"SIGWINCH": true,
+}